@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"go_sql_converter/internal"
+)
+
+const archiveUsage = `Usage: main archive run
+
+Writes the sensor_data rows of whole months older than archive.keep_days to
+archive.dir and deletes them, as the daily archive job does.
+`
+
+func runArchive(args []string) int {
+	if len(args) != 1 || args[0] != "run" {
+		fmt.Fprint(os.Stderr, archiveUsage)
+		return 2
+	}
+	config := loadConfig()
+	db := setupDatabase(config)
+	defer db.Close()
+	n, err := internal.RunArchive(config, db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Archived and deleted %d rows.\n", n)
+	return 0
+}
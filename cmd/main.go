@@ -1,51 +1,153 @@
 package main
 
 import (
-	"log"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"go_sql_converter/internal"
-
-	"gopkg.in/yaml.v3"
 )
 
+// configPath is set by --config, before the command: main --config FILE [command]
+var configPath = flag.String("config", configPathDefault(), "config file, also set by CONVERTER_CONFIG")
+
+func configPathDefault() string {
+	if path := os.Getenv("CONVERTER_CONFIG"); path != "" {
+		return path
+	}
+	return "config/config.yaml"
+}
+
 func main() {
-	log.Println("Starting MQTT Subscriber...")
-
-	// Read config
-	log.Println("Loading configuration from config/config.yaml...")
-	var config internal.Config
-	for {
-		configFile, err := os.Open("config/config.yaml")
-		if err != nil {
-			log.Printf("Error opening config file: %v. Retrying in 5 seconds...", err)
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		defer configFile.Close()
-
-		decoder := yaml.NewDecoder(configFile)
-		err = decoder.Decode(&config)
-		if err != nil {
-			log.Printf("Error decoding config: %v. Retrying in 5 seconds...", err)
-			configFile.Close()
-			time.Sleep(5 * time.Second)
-			continue
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: main [--config FILE] [quarantine|rollup|archive|migrate ...]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "quarantine":
+			os.Exit(runQuarantine(args[1:]))
+		case "rollup":
+			os.Exit(runRollup(args[1:]))
+		case "archive":
+			os.Exit(runArchive(args[1:]))
+		case "migrate":
+			os.Exit(runMigrate(args[1:]))
 		}
-		log.Println("Config loaded successfully.")
-		break
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	// Setup database
-	db := internal.SetupDatabase(config)
+	slog.Info("Starting MQTT Subscriber...")
+	config := loadConfig()
+
+	db := setup(config)
 	defer db.Close()
 
+	// Compress/delete old device logs and keep index.html up to date
+	internal.StartDeviceLogMaintenance()
+
+	// Integrate Totalizer1/2 and latch daily and monthly totals
+	internal.StartTotalizer(config, db)
+
+	// Catch up the rollups missed while stopped and keep their coverage current
+	internal.StartRollupMaintenance(db)
+
+	// Move old sensor_data rows to archive files once a day
+	internal.StartArchive(config, db)
+
+	// Health, readiness and status endpoints for monitoring
+	internal.StartHTTPServer(config, db)
+
 	// Setup MQTT and subscribe
 	internal.SetupMQTT(config, db)
 
-	// Keep running
-	for {
-		time.Sleep(1 * time.Second)
+	// Keep running until stopped, then flush the device logs
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String())
+	internal.StopSigning()
+	internal.CloseDeviceLog()
+}
+
+// loadConfig exits when the config file cannot be read or is invalid rather
+// than waiting for it to be fixed.
+func loadConfig() internal.Config {
+	slog.Info("Loading configuration", "file", *configPath)
+	config, err := internal.LoadConfig(*configPath)
+	if err != nil {
+		var configErr *internal.ConfigError
+		if errors.As(err, &configErr) {
+			for _, problem := range configErr.Problems {
+				slog.Error("Invalid configuration", "file", *configPath, "problem", problem)
+			}
+		} else {
+			slog.Error("Loading configuration failed", "file", *configPath, "error", err)
+		}
+		os.Exit(1)
+	}
+	slog.Info("Config loaded successfully.")
+	return config
+}
+
+// setupDatabase opens the database for the commands that only read or
+// maintain tables, without the background jobs and checks of setup.
+func setupDatabase(config internal.Config) *sql.DB {
+	// Setup log level and format first so every later message uses them
+	internal.SetupLogging(config)
+
+	// Setup timezone before the database so the session time_zone matches
+	if err := internal.SetupTimezone(config); err != nil {
+		slog.Error("Loading timezone failed", "error", err)
+		os.Exit(1)
+	}
+
+	// Setup database
+	db := internal.SetupDatabase(config)
+
+	// Refuse to run against a schema without the columns the code uses
+	if err := internal.CheckSchema(config, db); err != nil {
+		slog.Error("Checking database schema failed", "error", err)
+		os.Exit(1)
 	}
+	return db
+}
+
+// setup prepares everything message processing depends on. It is shared by
+// the service and the commands that reprocess stored messages.
+func setup(config internal.Config) *sql.DB {
+	db := setupDatabase(config)
+
+	// Setup per-device message log
+	internal.SetupDeviceLog(config)
+
+	// Setup hourly and daily rollups of sensor_data
+	internal.SetupRollups(config)
+
+	// Setup timestamp checks
+	internal.SetupTimestamps(config)
+
+	// Setup device authorization
+	internal.SetupAuthorization(config, db)
+
+	// Setup payload signature verification
+	if err := internal.SetupSigning(config, db); err != nil {
+		slog.Error("Loading signing keys failed", "error", err)
+		os.Exit(1)
+	}
+
+	// Setup handling of devices without a rdas_dev row
+	internal.SetupProvisioning(config)
+
+	// Setup duplicate detection
+	internal.SetupDedup(config, db)
+
+	return db
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go_sql_converter/internal"
+)
+
+const migrateUsage = `Usage: main migrate <command> [options]
+
+Commands:
+  status              list the migrations and when they were applied
+  up [-to VERSION]    apply the pending migrations, and with sql.timescale
+                      make sensor_data a TimescaleDB hypertable
+  down [-steps N]     revert the last N applied migrations (default 1)
+`
+
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("migrate "+cmd, flag.ExitOnError)
+	to := fs.Int("to", 0, "apply migrations up to this version")
+	steps := fs.Int("steps", 1, "number of migrations to revert")
+	if cmd != "status" && cmd != "up" && cmd != "down" {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+	fs.Parse(args)
+
+	// Not setup(): it refuses to run until the schema is migrated
+	config := loadConfig()
+	internal.SetupLogging(config)
+	if err := internal.SetupTimezone(config); err != nil {
+		slog.Error("Loading timezone failed", "error", err)
+		return 1
+	}
+	db := internal.SetupDatabase(config)
+	defer db.Close()
+
+	switch cmd {
+	case "status":
+		statuses, err := internal.MigrationStatuses(db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("%-8s %-32s %s\n", "VERSION", "NAME", "APPLIED")
+		for _, s := range statuses {
+			applied := s.AppliedAt
+			if applied == "" {
+				applied = "pending"
+			}
+			fmt.Printf("%-8d %-32s %s\n", s.Version, s.Name, applied)
+		}
+		return 0
+
+	case "up":
+		applied, err := internal.MigrateUp(db, *to)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if config.SQL.Driver == "postgres" && config.SQL.Timescale {
+			if err := internal.EnableTimescale(db); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: enabling TimescaleDB: %v\n", err)
+				return 1
+			}
+			fmt.Println("sensor_data is a TimescaleDB hypertable.")
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date.")
+		}
+		return 0
+
+	default:
+		reverted, err := internal.MigrateDown(db, *steps)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+}
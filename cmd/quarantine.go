@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go_sql_converter/internal"
+)
+
+const quarantineUsage = `Usage: main quarantine <command> [options]
+
+Commands:
+  list [-device ID] [-status new|reprocessed] [-limit N]
+  show ID
+  reprocess [-force] [-topic TOPIC] [-payload JSON | -payload-file FILE] ID
+  purge (ID... | -older-than DURATION)
+`
+
+func runQuarantine(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, quarantineUsage)
+		return 2
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("quarantine "+cmd, flag.ExitOnError)
+
+	switch cmd {
+	case "list":
+		device := fs.String("device", "", "only messages of this device")
+		status := fs.String("status", "", "only messages with this status")
+		limit := fs.Int("limit", 50, "maximum number of messages")
+		fs.Parse(args)
+
+		db := setupDatabase(loadConfig())
+		defer db.Close()
+		msgs, err := internal.ListQuarantine(db, *device, *status, *limit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing quarantine: %v\n", err)
+			return 1
+		}
+		fmt.Printf("%-8s %-19s %-8s %-12s %-32s %s\n", "ID", "RECEIVED", "DEVICE", "STATUS", "TOPIC", "REASON")
+		for _, m := range msgs {
+			fmt.Printf("%-8d %-19s %-8s %-12s %-32s %s\n", m.ID, m.ReceivedAt, m.DeviceID, m.Status, m.Topic, m.Reason)
+		}
+		return 0
+
+	case "show":
+		fs.Parse(args)
+		id, ok := parseID(fs.Arg(0))
+		if !ok {
+			fmt.Fprint(os.Stderr, quarantineUsage)
+			return 2
+		}
+		db := setupDatabase(loadConfig())
+		defer db.Close()
+		m, err := internal.GetQuarantined(db, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("ID:          %d\nReceived:    %s\nTopic:       %s\nDevice:      %s\nReason:      %s\nStatus:      %s\n", m.ID, m.ReceivedAt, m.Topic, m.DeviceID, m.Reason, m.Status)
+		if m.ReprocessedAt.Valid {
+			fmt.Printf("Reprocessed: %s\n", m.ReprocessedAt.String)
+		}
+		fmt.Printf("Payload:\n%s\n", m.Payload)
+		return 0
+
+	case "reprocess":
+		topic := fs.String("topic", "", "replace the stored topic")
+		payload := fs.String("payload", "", "replace the stored payload")
+		payloadFile := fs.String("payload-file", "", "read the replacement payload from a file")
+		force := fs.Bool("force", false, "reprocess a message that was already reprocessed")
+		fs.Parse(args)
+		id, ok := parseID(fs.Arg(0))
+		if !ok {
+			fmt.Fprint(os.Stderr, quarantineUsage)
+			return 2
+		}
+		var fixed []byte
+		if *payloadFile != "" {
+			data, err := os.ReadFile(*payloadFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading payload file: %v\n", err)
+				return 1
+			}
+			fixed = data
+		} else if *payload != "" {
+			fixed = []byte(*payload)
+		}
+		db := setup(loadConfig())
+		defer db.Close()
+		defer internal.CloseDeviceLog()
+		if err := internal.ReprocessQuarantined(db, id, *topic, fixed, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reprocessing message %d: %v\n", id, err)
+			return 1
+		}
+		fmt.Printf("Message %d reprocessed.\n", id)
+		return 0
+
+	case "purge":
+		olderThan := fs.Duration("older-than", 0, "delete messages received longer ago than this (e.g. 720h)")
+		fs.Parse(args)
+		var ids []int64
+		for _, arg := range fs.Args() {
+			id, ok := parseID(arg)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Invalid id %q\n", arg)
+				return 2
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 && *olderThan <= 0 {
+			fmt.Fprint(os.Stderr, quarantineUsage)
+			return 2
+		}
+		db := setupDatabase(loadConfig())
+		defer db.Close()
+		n, err := internal.PurgeQuarantine(db, ids, *olderThan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error purging quarantine: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Deleted %d messages.\n", n)
+		return 0
+	}
+
+	fmt.Fprint(os.Stderr, quarantineUsage)
+	return 2
+}
+
+func parseID(s string) (int64, bool) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	return id, err == nil && id > 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go_sql_converter/internal"
+)
+
+const rollupUsage = `Usage: main rollup rebuild [-device ID] [-from DATE] [-to DATE]
+
+Recomputes sensor_rollup_hour and sensor_rollup_day from sensor_data for the
+whole days from -from (default: the oldest reading) up to -to (default: now)
+and records them in sensor_rollup_coverage, so that aggregate queries use
+them. Days before the oldest reading, such as archived months, are not
+rebuilt and keep their rollups. The service may keep running meanwhile.
+`
+
+func runRollup(args []string) int {
+	if len(args) == 0 || args[0] != "rebuild" {
+		fmt.Fprint(os.Stderr, rollupUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("rollup rebuild", flag.ExitOnError)
+	device := fs.String("device", "", "only this device")
+	fromArg := fs.String("from", "", "first day, e.g. 2025-01-01")
+	toArg := fs.String("to", "", "end, e.g. 2025-02-01 (exclusive)")
+	fs.Parse(args[1:])
+
+	config := loadConfig()
+	if !config.Rollup.Enabled {
+		fmt.Fprintln(os.Stderr, "Error: rollup.enabled is false in config.yaml")
+		return 1
+	}
+	db := setupDatabase(config)
+	defer db.Close()
+
+	// Dates are read in the configured timezone, which setupDatabase loads
+	var from time.Time
+	to := time.Now()
+	for _, p := range []struct {
+		arg string
+		t   *time.Time
+	}{{*fromArg, &from}, {*toArg, &to}} {
+		if p.arg == "" {
+			continue
+		}
+		t, err := internal.ParseTime(p.arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 2
+		}
+		*p.t = t
+	}
+
+	days, err := internal.RebuildRollups(db, *device, from, to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error after %d days: %v\n", days, err)
+		return 1
+	}
+	fmt.Printf("Rebuilt rollups of %d days.\n", days)
+	return 0
+}
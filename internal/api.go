@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query API reads sensor_data and rdas_dev through the store. Every
+// endpoint returns JSON, or CSV with ?format=csv or Accept: text/csv.
+
+const (
+	apiDefaultLimit = 1000
+	apiMaxLimit     = 10000
+	apiMaxBuckets   = 10000
+)
+
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/devices", apiDevices)
+	mux.HandleFunc("GET /api/devices/{id}/latest", apiLatest)
+	mux.HandleFunc("GET /api/devices/{id}/readings", apiReadings)
+	mux.HandleFunc("GET /api/devices/{id}/aggregate", apiAggregate)
+}
+
+func apiDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := store.Devices("")
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if wantsCSV(r) {
+		rows := [][]string{{"device_id", "name", "project", "latest_data", "sensor1", "sensor2", "sensor3", "sensor4", "unbox", "main_power", "gsm_signal"}}
+		for _, d := range devices {
+			rows = append(rows, []string{d.DeviceID, d.Name, d.Project, d.LatestData, d.Sensors[0], d.Sensors[1], d.Sensors[2], d.Sensors[3], d.UnBox,
+				formatFloat(d.MainPower), strconv.Itoa(d.GSMSignal)})
+		}
+		writeCSV(w, "devices.csv", rows)
+		return
+	}
+	if devices == nil {
+		devices = []Device{}
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func apiLatest(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	reading, ok, err := store.LatestReading(id)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		apiError(w, r, http.StatusNotFound, fmt.Errorf("no readings for device %s", id))
+		return
+	}
+	if wantsCSV(r) {
+		writeCSV(w, id+"-latest.csv", append([][]string{readingCSVHeader}, readingCSV(reading)))
+		return
+	}
+	writeJSON(w, http.StatusOK, reading)
+}
+
+func apiReadings(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	from, to, err := timeRange(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := intParam(r, "limit", apiDefaultLimit)
+	if err == nil && (limit < 1 || limit > apiMaxLimit) {
+		err = fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+	}
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	offset, err := intParam(r, "offset", 0)
+	if err == nil && offset < 0 {
+		err = fmt.Errorf("offset must not be negative")
+	}
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	readings, err := store.History(id, from, to, limit, offset)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// A full page may be followed by more readings
+	var next *int
+	if len(readings) == limit {
+		n := offset + limit
+		next = &n
+		w.Header().Set("X-Next-Offset", strconv.Itoa(n))
+	}
+	if wantsCSV(r) {
+		rows := [][]string{readingCSVHeader}
+		for _, reading := range readings {
+			rows = append(rows, readingCSV(reading))
+		}
+		writeCSV(w, id+"-readings.csv", rows)
+		return
+	}
+	if readings == nil {
+		readings = []Reading{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		DeviceID   string    `json:"device_id"`
+		From       time.Time `json:"from"`
+		To         time.Time `json:"to"`
+		Limit      int       `json:"limit"`
+		Offset     int       `json:"offset"`
+		NextOffset *int      `json:"next_offset"`
+		Readings   []Reading `json:"readings"`
+	}{id, from, to, limit, offset, next, readings})
+}
+
+func apiAggregate(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	from, to, err := timeRange(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	interval := time.Hour
+	if v := r.URL.Query().Get("interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval < time.Second {
+			apiError(w, r, http.StatusBadRequest, fmt.Errorf("invalid interval %q, use e.g. 15m, 1h or 24h", v))
+			return
+		}
+	}
+	if to.Sub(from)/interval > apiMaxBuckets {
+		apiError(w, r, http.StatusBadRequest, fmt.Errorf("more than %d intervals requested, use a longer interval", apiMaxBuckets))
+		return
+	}
+
+	rows, err := store.Aggregate(id, from, to, interval)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if wantsCSV(r) {
+		out := [][]string{{"start", "count",
+			"min1", "min2", "min3", "min4", "max1", "max2", "max3", "max4", "avg1", "avg2", "avg3", "avg4"}}
+		for _, a := range rows {
+			row := []string{a.Start.Format(sqlDateTime), strconv.FormatInt(a.Count, 10)}
+			for _, values := range [][4]float64{a.Min, a.Max, a.Avg} {
+				for _, v := range values {
+					row = append(row, formatFloat(v))
+				}
+			}
+			out = append(out, row)
+		}
+		writeCSV(w, id+"-aggregate.csv", out)
+		return
+	}
+	if rows == nil {
+		rows = []Aggregate{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		DeviceID  string      `json:"device_id"`
+		From      time.Time   `json:"from"`
+		To        time.Time   `json:"to"`
+		Interval  string      `json:"interval"`
+		Intervals []Aggregate `json:"intervals"`
+	}{id, from, to, interval.String(), rows})
+}
+
+var readingCSVHeader = []string{"device_id", "date_time", "sensor1", "sensor2", "sensor3", "sensor4", "unbox"}
+
+func readingCSV(r Reading) []string {
+	return []string{r.DeviceID, r.Time.Format(sqlDateTime),
+		formatFloat(r.Sensors[0]), formatFloat(r.Sensors[1]), formatFloat(r.Sensors[2]), formatFloat(r.Sensors[3]), r.UnBox}
+}
+
+// timeRange reads ?from= and ?to=, by default the last 24 hours.
+func timeRange(r *http.Request) (time.Time, time.Time, error) {
+	to := localNow()
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := ParseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := ParseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// ParseTime accepts RFC 3339 or a datetime or date in the configured
+// timezone.
+func ParseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.In(location), nil
+	}
+	for _, layout := range []string{sqlDateTime, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339, 2006-01-02 15:04:05 or 2006-01-02", v)
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+func wantsCSV(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+func writeCSV(w http.ResponseWriter, filename string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+	if err := cw.Error(); err != nil {
+		slog.Debug("Writing CSV response failed", "error", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		slog.Error("API request failed", "path", r.URL.Path, "error", err)
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The archive job moves sensor_data rows of whole months older than
+// keep_days to gzipped CSV files, one per device and month:
+// <dir>/<deviceID>/<deviceID>_2025-01.csv.gz. Rows are deleted only after the
+// file has been read back and holds every row of the month. Rows that arrive
+// for an archived month later go to a further part, _2025-01.2.csv.gz.
+
+// ArchiveConfig is the archive section of config.yaml.
+type ArchiveConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Dir        string        `yaml:"dir"`
+	KeepDays   int           `yaml:"keep_days"`
+	RunAt      string        `yaml:"run_at"` // HH:MM
+	BatchSize  int           `yaml:"batch_size"`
+	BatchPause time.Duration `yaml:"batch_pause"`
+}
+
+var archiveColumns = []string{"Idx", "deviceID", "HWSerial", "status", "sensor1", "sensor2", "sensor3", "sensor4",
+	"sensor5", "sensor6", "sensor7", "sensor8", "TempInside", "TempOutside", "MainPower", "Battery",
+	"SensorPowerStatus", "GSMSignal", "Current_timestamp", "date_time", "UnBox", "Alert"}
+
+var metricArchived = newMetric("counter", "converter_archived_rows_total",
+	"sensor_data rows written to archive files and deleted.", nil)
+
+type archiver struct {
+	db     *sql.DB
+	config ArchiveConfig
+	runAt  int // minutes after midnight
+}
+
+func newArchiver(config ArchiveConfig, db *sql.DB) (*archiver, error) {
+	if config.Dir == "" {
+		config.Dir = "archive"
+	}
+	if config.KeepDays <= 0 {
+		config.KeepDays = 90
+	}
+	if config.RunAt == "" {
+		config.RunAt = "03:00"
+	}
+	runAt, err := time.Parse("15:04", config.RunAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid run_at %q, use HH:MM", config.RunAt)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+	return &archiver{db: db, config: config, runAt: runAt.Hour()*60 + runAt.Minute()}, nil
+}
+
+// due reports whether the daily run is due at now, given the day of the last
+// run. run_at is compared as minutes after midnight, so "3:00" and "03:00"
+// are the same time.
+func (a *archiver) due(now time.Time, lastRun string) bool {
+	return now.Format("2006-01-02") != lastRun && now.Hour()*60+now.Minute() >= a.runAt
+}
+
+// StartArchive runs the archive job once a day at run_at.
+func StartArchive(config Config, db *sql.DB) {
+	if !config.Archive.Enabled {
+		return
+	}
+	a, err := newArchiver(config.Archive, db)
+	if err == nil {
+		err = errMySQLOnly("archive")
+	}
+	if err != nil {
+		slog.Error("Archive disabled", "error", err)
+		return
+	}
+	slog.Info("Archive job started", "dir", a.config.Dir, "keep_days", a.config.KeepDays, "run_at", a.config.RunAt)
+	go func() {
+		lastRun := ""
+		for {
+			now := localNow()
+			if a.due(now, lastRun) {
+				if _, err := a.run(); err != nil {
+					slog.Error("Archive run failed", "error", err)
+				}
+				lastRun = now.Format("2006-01-02")
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// RunArchive runs the archive job once and returns the number of rows
+// archived.
+func RunArchive(config Config, db *sql.DB) (int64, error) {
+	if err := errMySQLOnly("archive"); err != nil {
+		return 0, err
+	}
+	a, err := newArchiver(config.Archive, db)
+	if err != nil {
+		return 0, err
+	}
+	return a.run()
+}
+
+// cutoff is the start of the month that holds the day keep_days ago. Rows
+// before it are archived, so at least keep_days stay online.
+func (a *archiver) cutoff() time.Time {
+	t := localNow().AddDate(0, 0, -a.config.KeepDays)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+}
+
+func (a *archiver) run() (int64, error) {
+	cutoff := a.cutoff()
+	rows, err := a.db.Query("SELECT DISTINCT deviceID, DATE_FORMAT(date_time, '%Y-%m') FROM sensor_data WHERE date_time < ? ORDER BY 1, 2", cutoff.Format(sqlDateTime))
+	if err != nil {
+		return 0, err
+	}
+	type deviceMonth struct {
+		deviceID string
+		month    time.Time
+	}
+	var todo []deviceMonth
+	for rows.Next() {
+		var d deviceMonth
+		var month string
+		if err := rows.Scan(&d.deviceID, &month); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if d.month, err = time.ParseInLocation("2006-01", month, location); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		todo = append(todo, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	slog.Info("Archive run started", "cutoff", cutoff.Format("2006-01-02"), "months", len(todo))
+	var total int64
+	failed := 0
+	for _, d := range todo {
+		n, err := a.archiveMonth(d.deviceID, d.month)
+		total += n
+		if err != nil {
+			// Other devices and months do not depend on this one
+			slog.Error("Archiving month failed", "deviceID", d.deviceID, "month", d.month.Format("2006-01"), "error", err)
+			failed++
+		}
+	}
+	slog.Info("Archive run finished", "rows", total, "failed", failed)
+	if failed > 0 {
+		return total, fmt.Errorf("%d of %d months failed, see the log", failed, len(todo))
+	}
+	return total, nil
+}
+
+// archiveMonth writes the rows of a device and month that are not in an
+// archive file yet to a new part, verifies that every row is archived and
+// deletes them.
+func (a *archiver) archiveMonth(deviceID string, month time.Time) (int64, error) {
+	if deviceID == "" || deviceID != filepath.Base(deviceID) || strings.HasPrefix(deviceID, ".") {
+		return 0, fmt.Errorf("device ID %q cannot be used as a directory name", deviceID)
+	}
+	dir := filepath.Join(a.config.Dir, deviceID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	base := deviceID + "_" + month.Format("2006-01")
+	parts, err := filepath.Glob(filepath.Join(dir, base+"*.csv.gz"))
+	if err != nil {
+		return 0, err
+	}
+	archived := make(map[int64]bool)
+	for _, part := range parts {
+		if err := readArchivedIdx(part, archived); err != nil {
+			return 0, fmt.Errorf("reading %s: %w", part, err)
+		}
+	}
+
+	from, to := month, month.AddDate(0, 1, 0)
+	name := filepath.Join(dir, base+".csv.gz")
+	if len(parts) > 0 {
+		name = filepath.Join(dir, fmt.Sprintf("%s.%d.csv.gz", base, len(parts)+1))
+	}
+	seen, written, err := a.export(deviceID, from, to, archived, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(seen) == 0 {
+		return 0, nil
+	}
+	if written == 0 {
+		name = ""
+	} else {
+		// Read the new part back rather than trusting the writer
+		check := make(map[int64]bool)
+		if err := readArchivedIdx(name, check); err != nil {
+			return 0, fmt.Errorf("verifying %s: %w", name, err)
+		}
+		if int64(len(check)) != written {
+			return 0, fmt.Errorf("%s holds %d rows, %d were written", name, len(check), written)
+		}
+		for idx := range check {
+			archived[idx] = true
+		}
+	}
+
+	// Every row up to the highest Idx exported must be in a file before
+	// anything is deleted; rows inserted since have a higher Idx
+	maxIdx := seen[len(seen)-1]
+	for _, idx := range seen {
+		if !archived[idx] {
+			return 0, fmt.Errorf("row %d is not in the archive files; nothing deleted", idx)
+		}
+	}
+	var count int
+	err = a.db.QueryRow("SELECT COUNT(*) FROM sensor_data WHERE deviceID = ? AND date_time >= ? AND date_time < ? AND Idx <= ?",
+		deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime), maxIdx).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	if count != len(seen) {
+		return 0, fmt.Errorf("sensor_data has %d rows, %d were exported; nothing deleted", count, len(seen))
+	}
+
+	deleted, err := a.deleteArchived(deviceID, from, to, maxIdx)
+	metricArchived.add(float64(deleted))
+	slog.Info("Archived month", "deviceID", deviceID, "month", month.Format("2006-01"), "written", written, "deleted", deleted, "file", name)
+	return deleted, err
+}
+
+// export writes the rows of the month that are not in archived to name. It
+// returns the Idx of every row of the month in ascending order and how many
+// rows it wrote.
+func (a *archiver) export(deviceID string, from, to time.Time, archived map[int64]bool, name string) ([]int64, int64, error) {
+	rows, err := a.db.Query("SELECT `"+strings.Join(archiveColumns, "`, `")+"` FROM sensor_data WHERE deviceID = ? AND date_time >= ? AND date_time < ? ORDER BY Idx",
+		deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	w := csv.NewWriter(zw)
+	w.Write(archiveColumns)
+
+	var seen []int64
+	var written int64
+	values := make([]sql.NullString, len(archiveColumns))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	record := make([]string, len(values))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, 0, err
+		}
+		idx, err := strconv.ParseInt(values[0].String, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		seen = append(seen, idx)
+		if archived[idx] {
+			continue
+		}
+		// NULL and empty are both written as an empty field
+		for i, v := range values {
+			record[i] = v.String
+		}
+		if err := w.Write(record); err != nil {
+			return nil, 0, err
+		}
+		written++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if written == 0 {
+		return seen, 0, nil
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, 0, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, 0, err
+	}
+	return seen, written, os.Rename(tmp, name)
+}
+
+// readArchivedIdx adds the Idx of every row in an archive file to idx.
+func readArchivedIdx(name string, idx map[int64]bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	r := csv.NewReader(zr)
+	r.ReuseRecord = true
+	if _, err := r.Read(); err != nil {
+		return err
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		idx[n] = true
+	}
+}
+
+// deleteArchived deletes the archived rows in batches, pausing in between so
+// ingestion is not locked out.
+func (a *archiver) deleteArchived(deviceID string, from, to time.Time, maxIdx int64) (int64, error) {
+	var total int64
+	for {
+		res, err := execSQL(a.db, "delete_archived", deviceID, "DELETE FROM sensor_data WHERE deviceID = ? AND date_time >= ? AND date_time < ? AND Idx <= ? ORDER BY Idx LIMIT ?",
+			deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime), maxIdx, a.config.BatchSize)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < int64(a.config.BatchSize) {
+			return total, nil
+		}
+		time.Sleep(a.config.BatchPause)
+	}
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArchiverDue(t *testing.T) {
+	tests := []struct {
+		runAt   string
+		now     string
+		lastRun string
+		want    bool
+	}{
+		{"03:00", "2024-05-01 02:59", "2024-04-30", false},
+		{"03:00", "2024-05-01 03:00", "2024-04-30", true},
+		{"03:00", "2024-05-01 23:10", "2024-04-30", true},
+		{"03:00", "2024-05-01 03:00", "2024-05-01", false},
+		// Without the leading zero "3:00" sorted after "23:59" as a string
+		{"3:00", "2024-05-01 03:00", "2024-04-30", true},
+		{"3:00", "2024-05-01 10:00", "2024-04-30", true},
+		{"3:00", "2024-05-01 02:30", "2024-04-30", false},
+		{"0:05", "2024-05-01 00:05", "", true},
+		{"23:30", "2024-05-01 23:29", "2024-04-30", false},
+	}
+	for _, tt := range tests {
+		a, err := newArchiver(ArchiveConfig{RunAt: tt.runAt}, nil)
+		if err != nil {
+			t.Fatalf("newArchiver(%q): %v", tt.runAt, err)
+		}
+		now, _ := time.Parse("2006-01-02 15:04", tt.now)
+		if got := a.due(now, tt.lastRun); got != tt.want {
+			t.Errorf("run_at %s at %s after %q: due = %v, want %v", tt.runAt, tt.now, tt.lastRun, got, tt.want)
+		}
+	}
+}
+
+func TestNewArchiverRunAt(t *testing.T) {
+	for _, runAt := range []string{"3", "25:00", "03:60", "3am"} {
+		if _, err := newArchiver(ArchiveConfig{RunAt: runAt}, nil); err == nil {
+			t.Errorf("newArchiver(%q) accepted an invalid run_at", runAt)
+		}
+	}
+}
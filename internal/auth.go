@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	actionAllow      = "allow"
+	actionReject     = "reject"
+	actionQuarantine = "quarantine"
+)
+
+type authPolicy struct {
+	enabled        bool
+	idPattern      *regexp.Regexp
+	unknownAction  string
+	disabledAction string
+	disabled       map[string]bool
+	quarantineLog  string
+}
+
+var auth = authPolicy{
+	idPattern:      regexp.MustCompile(`^[A-Za-z0-9]{1,6}$`),
+	unknownAction:  actionQuarantine,
+	disabledAction: actionReject,
+	quarantineLog:  "log/quarantine.log",
+}
+
+// deviceRegistry caches the devIDs of rdas_dev with their Project so that
+// authorizing a message or filtering the stream by project does not cost a
+// query. It is reloaded periodically when either is enabled.
+type deviceRegistry struct {
+	mu      sync.RWMutex
+	devices map[string]string
+	missing map[string]time.Time
+	refresh sync.Once
+}
+
+var registry = &deviceRegistry{
+	devices: make(map[string]string),
+	missing: make(map[string]time.Time),
+}
+
+// missingTTL is how long a device ID found missing from rdas_dev is not
+// looked up again, so that a newly added device is accepted before the next
+// reload.
+const missingTTL = time.Minute
+
+var quarantineMu sync.Mutex
+
+func SetupAuthorization(config Config, db *sql.DB) {
+	c := config.Authorization
+	if !c.Enabled {
+		slog.Info("Device authorization disabled.")
+		return
+	}
+	auth.enabled = true
+	if c.DeviceIDPattern != "" {
+		re, err := regexp.Compile(c.DeviceIDPattern)
+		if err != nil {
+			slog.Warn("Invalid authorization.device_id_pattern, using the default", "pattern", c.DeviceIDPattern, "default", auth.idPattern.String(), "error", err)
+		} else {
+			auth.idPattern = re
+		}
+	}
+	auth.unknownAction = validAction(c.UnknownAction, auth.unknownAction)
+	auth.disabledAction = validAction(c.DisabledAction, auth.disabledAction)
+	if auth.disabledAction == actionAllow {
+		auth.disabledAction = actionReject
+	}
+	auth.disabled = make(map[string]bool)
+	for _, id := range c.DisabledDevices {
+		auth.disabled[id] = true
+	}
+	if c.QuarantineLog != "" {
+		auth.quarantineLog = c.QuarantineLog
+	}
+
+	registry.startRefresh(db, c.RefreshInterval)
+	slog.Info("Device authorization enabled", "pattern", auth.idPattern.String(), "unknown", auth.unknownAction, "disabled", auth.disabledAction, "quarantineLog", auth.quarantineLog)
+}
+
+func validAction(action, def string) string {
+	switch action {
+	case "":
+		return def
+	case actionAllow, actionReject, actionQuarantine:
+		return action
+	}
+	slog.Warn("Unknown authorization action, using the default", "action", action, "default", def)
+	return def
+}
+
+// startRefresh loads the registry and reloads it every interval. Only the
+// first call has an effect.
+func (r *deviceRegistry) startRefresh(db *sql.DB, interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	r.refresh.Do(func() {
+		r.load(db)
+		go func() {
+			for range time.Tick(interval) {
+				r.load(db)
+			}
+		}()
+	})
+}
+
+func (r *deviceRegistry) load(db *sql.DB) {
+	rows, err := db.Query("SELECT devID, Project FROM rdas_dev")
+	if err != nil {
+		slog.Error("Loading devices from rdas_dev failed", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	devices := make(map[string]string)
+	for rows.Next() {
+		var id, project string
+		if err := rows.Scan(&id, &project); err != nil {
+			slog.Error("Scanning rdas_dev row failed", "error", err)
+			return
+		}
+		devices[id] = project
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Loading devices from rdas_dev failed", "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	r.devices = devices
+	r.missing = make(map[string]time.Time)
+	r.mu.Unlock()
+	slog.Info("Loaded devices from rdas_dev", "devices", len(devices))
+}
+
+// maxMissing bounds the device IDs remembered as missing between refreshes,
+// since a topic can carry any device ID.
+const maxMissing = 10000
+
+// known reports whether deviceID has a rdas_dev row. Devices missing from the
+// cache are looked up and remembered as missing for missingTTL. A failed
+// lookup is returned as an error and not remembered.
+func (r *deviceRegistry) known(db *sql.DB, deviceID string) (bool, error) {
+	r.mu.RLock()
+	_, ok := r.devices[deviceID]
+	missingSince, missing := r.missing[deviceID]
+	r.mu.RUnlock()
+	if ok || (missing && time.Since(missingSince) < missingTTL) {
+		return ok, nil
+	}
+
+	var project string
+	err := db.QueryRow(rebind("SELECT Project FROM rdas_dev WHERE devID = ? LIMIT 1"), deviceID).Scan(&project)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == sql.ErrNoRows {
+		if len(r.missing) >= maxMissing {
+			r.missing = make(map[string]time.Time)
+		}
+		r.missing[deviceID] = time.Now()
+		return false, nil
+	}
+	r.devices[deviceID] = project
+	return true, nil
+}
+
+// project returns the cached Project of a device, or "" if the device is not
+// in the registry yet. It never queries the database.
+func (r *deviceRegistry) project(deviceID string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.devices[deviceID]
+}
+
+func (r *deviceRegistry) remember(deviceID, project string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices[deviceID] = project
+	delete(r.missing, deviceID)
+}
+
+// authorizeDevice decides whether a message may be written. When it returns
+// false the message has already been recorded in the quarantine log, and for
+// the quarantine action also in the mqtt_quarantine table for reprocessing.
+func authorizeDevice(db *sql.DB, topic, deviceID string, payload []byte) bool {
+	if !auth.enabled {
+		return true
+	}
+	action, reason := actionAllow, ""
+	switch {
+	case !auth.idPattern.MatchString(deviceID):
+		action, reason = actionReject, fmt.Sprintf("device ID does not match %s", auth.idPattern)
+	case auth.disabled[deviceID]:
+		action, reason = auth.disabledAction, "device is disabled"
+	default:
+		known, err := registry.known(db, deviceID)
+		if err != nil {
+			// Fail closed; quarantined messages can be reprocessed once the
+			// device is confirmed, and the quarantine log keeps the payload
+			// if the database is unreachable altogether
+			action, reason = actionQuarantine, fmt.Sprintf("looking up device failed: %v", err)
+		} else if !known {
+			action, reason = auth.unknownAction, "device not found in rdas_dev"
+		}
+	}
+	if action == actionAllow {
+		return true
+	}
+	slog.Warn("Rejected message", "deviceID", deviceID, "topic", topic, "action", action, "reason", reason)
+	stats.count("rejected")
+	recordQuarantine(auth.quarantineLog, topic, deviceID, action, reason, payload)
+	if action == actionQuarantine {
+		quarantineMessage(db, topic, deviceID, payload, reason)
+	}
+	return false
+}
+
+type quarantineEntry struct {
+	Time     string `json:"time"`
+	Topic    string `json:"topic"`
+	DeviceID string `json:"device_id"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	Payload  string `json:"payload"`
+}
+
+// recordQuarantine appends a rejected publish to the log at path as one JSON
+// object per line.
+func recordQuarantine(path, topic, deviceID, action, reason string, payload []byte) {
+	entry, err := json.Marshal(quarantineEntry{
+		Time:     localNow().Format("2006-01-02 15:04:05"),
+		Topic:    topic,
+		DeviceID: deviceID,
+		Action:   action,
+		Reason:   reason,
+		Payload:  string(payload),
+	})
+	if err != nil {
+		slog.Error("Encoding quarantine entry failed", "deviceID", deviceID, "error", err)
+		return
+	}
+
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.Error("Creating quarantine log directory failed", "file", path, "error", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		slog.Error("Opening quarantine log failed", "file", path, "error", err)
+		return
+	}
+	defer file.Close()
+	file.Write(append(entry, '\n'))
+}
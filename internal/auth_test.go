@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"database/sql"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeDevice(t *testing.T) {
+	defer func(a authPolicy) { auth = a }(auth)
+	if auth.unknownAction != actionQuarantine {
+		t.Errorf("default unknown action = %s, want %s", auth.unknownAction, actionQuarantine)
+	}
+	defer func(r *deviceRegistry) { registry = r }(registry)
+	// Nothing listens on port 1, so every lookup fails
+	db, err := sql.Open("mysql", "u:p@tcp(127.0.0.1:1)/x?timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	auth = authPolicy{
+		enabled:        true,
+		idPattern:      regexp.MustCompile(`^[A-Za-z0-9]{1,6}$`),
+		unknownAction:  actionQuarantine,
+		disabledAction: actionReject,
+		disabled:       map[string]bool{"OFF1": true},
+		quarantineLog:  filepath.Join(t.TempDir(), "quarantine.log"),
+	}
+	registry = &deviceRegistry{
+		devices: map[string]string{"DEV1": "P", "OFF1": "P"},
+		missing: map[string]time.Time{"NEW1": time.Now()},
+	}
+	tests := []struct {
+		name     string
+		deviceID string
+		want     bool
+	}{
+		{"known", "DEV1", true},
+		{"bad id", "DEV1/x", false},
+		{"disabled", "OFF1", false},
+		{"unknown", "NEW1", false},
+		{"lookup fails", "DEV2", false},
+	}
+	for _, tt := range tests {
+		if got := authorizeDevice(db, "t", tt.deviceID, []byte("{}")); got != tt.want {
+			t.Errorf("%s: authorizeDevice(%s) = %v, want %v", tt.name, tt.deviceID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration is read from a YAML file, then any field can be
+// overridden by an environment variable named after its YAML path:
+// CONVERTER_SQL_PASS sets sql.pass, CONVERTER_TOTALIZER_TOTALIZER1_SENSOR sets
+// totalizer.totalizer1.sensor. Lists are comma separated and maps are
+// comma-separated key=value pairs. Passwords can also be read from the file
+// named by pass_file, which the shipped config.yaml does.
+
+const envPrefix = "CONVERTER_"
+
+// yaml.v3 names the anonymous section struct in full
+var unknownFieldRe = regexp.MustCompile(`field (\S+) not found in type .*`)
+
+// ConfigError lists every invalid or missing field of a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// LoadConfig reads the config file, applies the environment overrides and
+// validates the result. Keys that are not Config fields are errors, so a
+// misspelt key is not silently ignored.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	f, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	var problems []string
+	if err := dec.Decode(&config); err != nil && err != io.EOF {
+		// A TypeError still decodes the other fields, so they are checked too
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return config, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		for _, e := range typeErr.Errors {
+			problems = append(problems, unknownFieldRe.ReplaceAllString(e, "unknown key $1"))
+		}
+	}
+
+	problems = append(problems, applyEnv(reflect.ValueOf(&config).Elem(), envPrefix, "")...)
+	// A password given in the environment wins over the pass_file of the file
+	for name, passFile := range map[string]*string{"MQTT": &config.MQTT.PassFile, "SQL": &config.SQL.PassFile} {
+		_, pass := os.LookupEnv(envPrefix + name + "_PASS")
+		_, file := os.LookupEnv(envPrefix + name + "_PASS_FILE")
+		if pass && !file {
+			*passFile = ""
+		}
+	}
+	problems = append(problems, readSecretFile("mqtt", &config.MQTT.Pass, config.MQTT.PassFile)...)
+	problems = append(problems, readSecretFile("sql", &config.SQL.Pass, config.SQL.PassFile)...)
+	problems = append(problems, validateConfig(config)...)
+	if len(problems) > 0 {
+		return config, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// applyEnv sets the fields of v from the environment variables prefix+TAG,
+// descending into nested structs.
+func applyEnv(v reflect.Value, prefix, path string) []string {
+	var problems []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		field := strings.TrimPrefix(path+"."+tag, ".")
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			problems = append(problems, applyEnv(fv, name+"_", field)...)
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (from %s): %v", field, name, err))
+			continue
+		}
+		slog.Debug("Config field set from environment", "field", field, "variable", name)
+	}
+	return problems
+}
+
+// readSecretFile sets *pass to the content of passFile, as mounted by Docker
+// secrets or systemd LoadCredential. Environment variables in the path are
+// expanded, so ${CREDENTIALS_DIRECTORY}/sql_pass works; one trailing newline
+// is removed.
+func readSecretFile(section string, pass *string, passFile string) []string {
+	if passFile == "" {
+		return nil
+	}
+	if *pass != "" {
+		return []string{section + ".pass_file: set either pass or pass_file, not both"}
+	}
+	data, err := os.ReadFile(os.ExpandEnv(passFile))
+	if err != nil {
+		if strings.Contains(passFile, "CREDENTIALS_DIRECTORY") && os.Getenv("CREDENTIALS_DIRECTORY") == "" {
+			return []string{fmt.Sprintf("%s.pass_file: %v (CREDENTIALS_DIRECTORY is only set by systemd LoadCredential; outside the service set %s%s_PASS)",
+				section, err, envPrefix, strings.ToUpper(section))}
+		}
+		return []string{fmt.Sprintf("%s.pass_file: %v", section, err)}
+	}
+	secret := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if secret == "" {
+		return []string{fmt.Sprintf("%s.pass_file: %s is empty", section, passFile)}
+	}
+	*pass = secret
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setFromEnv(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		m := make(map[string]string)
+		for _, pair := range strings.Split(s, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%q is not key=value", pair)
+			}
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfig returns a line for every invalid or missing field. Empty
+// optional fields are valid; the Setup functions fill in their defaults.
+func validateConfig(c Config) []string {
+	var problems []string
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.MQTT.Host == "" {
+		add("mqtt.host", "required")
+	}
+	if c.MQTT.Port < 1 || c.MQTT.Port > 65535 {
+		add("mqtt.port", "must be between 1 and 65535")
+	}
+	if c.MQTT.Protocol == "" {
+		add("mqtt.protocol", "required, e.g. tcp or ssl")
+	}
+	if c.MQTT.Topic == "" {
+		add("mqtt.topic", "required")
+	}
+
+	if !oneOf(c.SQL.Driver, "", "mysql", "postgres") {
+		add("sql.driver", "%q is not mysql or postgres", c.SQL.Driver)
+	}
+	if c.SQL.Host == "" {
+		add("sql.host", "required")
+	}
+	// lib/pq defaults to 5432, the MySQL DSN needs the port
+	if c.SQL.Port < 0 || c.SQL.Port > 65535 || (c.SQL.Port == 0 && c.SQL.Driver != "postgres") {
+		add("sql.port", "must be between 1 and 65535")
+	}
+	if c.SQL.User == "" {
+		add("sql.user", "required")
+	}
+	if c.SQL.Dbname == "" {
+		add("sql.dbname", "required")
+	}
+	if c.SQL.Driver != "postgres" {
+		if c.SQL.SSLMode != "" {
+			add("sql.sslmode", "only supported with driver postgres")
+		}
+		if c.SQL.Timescale {
+			add("sql.timescale", "only supported with driver postgres")
+		}
+	} else {
+		for _, f := range mysqlOnlyFeatures(c) {
+			add(f+".enabled", "not supported with sql.driver postgres")
+		}
+	}
+
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			add("timezone", "%v", err)
+		}
+	}
+	if c.Logging.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+			add("logging.level", "%q is not debug, info, warn or error", c.Logging.Level)
+		}
+	}
+	if !oneOf(strings.ToLower(c.Logging.Format), "", "text", "json") {
+		add("logging.format", "%q is not text or json", c.Logging.Format)
+	}
+	if !oneOf(c.Timestamp.Unit, "", "auto", "s", "ms") {
+		add("timestamp.unit", "%q is not auto, s or ms", c.Timestamp.Unit)
+	}
+	if !oneOf(c.UnknownDevice.Policy, "", unknownIgnore, unknownWarn, unknownCreate) {
+		add("unknown_device.policy", "%q is not ignore, warn or create", c.UnknownDevice.Policy)
+	}
+	for _, f := range c.DeviceLog.Formats {
+		if !oneOf(f, "html", "json", "text") {
+			add("device_log.formats", "%q is not html, json or text", f)
+		}
+	}
+
+	if c.Authorization.DeviceIDPattern != "" {
+		if _, err := regexp.Compile(c.Authorization.DeviceIDPattern); err != nil {
+			add("authorization.device_id_pattern", "%v", err)
+		}
+	}
+	if !oneOf(c.Authorization.UnknownAction, "", actionAllow, actionReject, actionQuarantine) {
+		add("authorization.unknown_action", "%q is not allow, reject or quarantine", c.Authorization.UnknownAction)
+	}
+	if !oneOf(c.Authorization.DisabledAction, "", actionAllow, actionReject, actionQuarantine) {
+		add("authorization.disabled_action", "%q is not allow, reject or quarantine", c.Authorization.DisabledAction)
+	}
+	if c.Signing.Enabled && c.Signing.KeyFile == "" && c.Signing.KeyTable == "" {
+		add("signing", "key_file or key_table is required when enabled")
+	}
+	if c.Signing.KeyTable != "" && !columnNameRe.MatchString(c.Signing.KeyTable) {
+		add("signing.key_table", "%q is not a table name", c.Signing.KeyTable)
+	}
+
+	if c.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Listen); err != nil {
+			add("http.listen", "%v", err)
+		}
+	}
+	if c.Archive.Enabled {
+		if _, err := newArchiver(c.Archive, nil); err != nil {
+			add("archive", "%v", err)
+		}
+	}
+	if c.Totalizer.Enabled {
+		if _, err := newTotalizerJob(c.Totalizer, nil); err != nil {
+			add("totalizer", "%v", err)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `mqtt:
+  host: "broker.local"
+  port: 1883
+  protocol: "tcp"
+  topic: "v1/devices/+/telemetry"
+sql:
+  host: "db.local"
+  port: 3306
+  user: "converter"
+  pass: "from-file"
+  dbname: "daq"
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "sql_pass")
+	if err := os.WriteFile(passFile, []byte("from-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		check   func(Config) string
+		problem string
+	}{
+		{"file only", testConfig, nil,
+			func(c Config) string { return c.MQTT.Host + " " + c.SQL.Pass }, "broker.local from-file"},
+		{"string and int", testConfig, map[string]string{"CONVERTER_MQTT_HOST": "10.0.0.2", "CONVERTER_MQTT_PORT": "8883"},
+			func(c Config) string { return fmt.Sprintf("%s %d", c.MQTT.Host, c.MQTT.Port) }, "10.0.0.2 8883"},
+		{"bool and duration", testConfig, map[string]string{"CONVERTER_HTTP_API": "true", "CONVERTER_TIMESTAMP_MAX_FUTURE": "90s"},
+			func(c Config) string { return fmt.Sprint(c.HTTP.API, c.Timestamp.MaxFuture) }, "true 1m30s"},
+		{"list", testConfig, map[string]string{"CONVERTER_DEVICE_LOG_FORMATS": "html, jsonl,", "CONVERTER_DEVICE_LOG_DIR": "/tmp"},
+			nil, `device_log.formats: "jsonl" is not html, json or text`},
+		{"nested struct", testConfig, map[string]string{"CONVERTER_TOTALIZER_TOTALIZER1_SENSOR": "3"},
+			func(c Config) string { return fmt.Sprint(c.Totalizer.Totalizer1.Sensor) }, "3"},
+		{"map", testConfig, map[string]string{"CONVERTER_UNKNOWN_DEVICE_TEMPLATE_COLUMNS": "Type=WL, 4mA_ss1 = 0,"},
+			func(c Config) string { return fmt.Sprint(c.UnknownDevice.Template.Columns) }, "map[4mA_ss1:0 Type:WL]"},
+		{"invalid map", testConfig, map[string]string{"CONVERTER_UNKNOWN_DEVICE_TEMPLATE_COLUMNS": "Type"},
+			nil, `unknown_device.template.columns (from CONVERTER_UNKNOWN_DEVICE_TEMPLATE_COLUMNS): "Type" is not key=value`},
+		{"invalid int", testConfig, map[string]string{"CONVERTER_MQTT_PORT": "mqtt"},
+			nil, "mqtt.port (from CONVERTER_MQTT_PORT)"},
+		{"invalid duration", testConfig, map[string]string{"CONVERTER_HTTP_OFFLINE_AFTER": "10"},
+			nil, "http.offline_after (from CONVERTER_HTTP_OFFLINE_AFTER)"},
+		{"pass_file from env", strings.Replace(testConfig, `  pass: "from-file"`, "", 1), map[string]string{"CONVERTER_SQL_PASS_FILE": passFile},
+			func(c Config) string { return c.SQL.Pass }, "from-secret"},
+		{"pass from env wins over pass_file of the file", strings.Replace(testConfig, `  pass: "from-file"`, `  pass_file: "/nonexistent/sql_pass"`, 1), map[string]string{"CONVERTER_SQL_PASS": "from-env"},
+			func(c Config) string { return c.SQL.Pass }, "from-env"},
+		{"pass and pass_file", testConfig, map[string]string{"CONVERTER_SQL_PASS_FILE": passFile},
+			nil, "sql.pass_file: set either pass or pass_file, not both"},
+		{"missing pass_file", strings.Replace(testConfig, `  pass: "from-file"`, `  pass_file: "${CREDENTIALS_DIRECTORY}/sql_pass"`, 1), map[string]string{"CREDENTIALS_DIRECTORY": ""},
+			nil, "CREDENTIALS_DIRECTORY is only set by systemd LoadCredential"},
+		{"unknown key", testConfig + "htpp:\n  listen: \":8080\"\n", nil,
+			nil, "unknown key htpp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			config, err := LoadConfig(writeConfig(t, tt.yaml))
+			if tt.check != nil {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				if got := tt.check(config); got != tt.problem {
+					t.Errorf("got %q, want %q", got, tt.problem)
+				}
+				return
+			}
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("LoadConfig error %v, want a ConfigError containing %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() Config {
+		var c Config
+		c.MQTT.Host, c.MQTT.Port, c.MQTT.Protocol, c.MQTT.Topic = "broker.local", 1883, "tcp", "v1/devices/+/telemetry"
+		c.SQL.Host, c.SQL.Port, c.SQL.User, c.SQL.Dbname = "db.local", 3306, "converter", "daq"
+		return c
+	}
+	tests := []struct {
+		name     string
+		change   func(*Config)
+		problems []string
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"required fields", func(c *Config) { *c = Config{} }, []string{
+			"mqtt.host: required", "mqtt.port: must be between 1 and 65535", "mqtt.protocol: required, e.g. tcp or ssl",
+			"mqtt.topic: required", "sql.host: required", "sql.port: must be between 1 and 65535", "sql.user: required", "sql.dbname: required",
+		}},
+		{"postgres default port", func(c *Config) { c.SQL.Driver, c.SQL.Port = "postgres", 0 }, nil},
+		{"unknown driver", func(c *Config) { c.SQL.Driver = "sqlite" }, []string{`sql.driver: "sqlite" is not mysql or postgres`}},
+		{"postgres options on mysql", func(c *Config) { c.SQL.SSLMode, c.SQL.Timescale = "require", true }, []string{
+			"sql.sslmode: only supported with driver postgres", "sql.timescale: only supported with driver postgres",
+		}},
+		{"mysql features on postgres", func(c *Config) {
+			c.SQL.Driver = "postgres"
+			c.Rollup.Enabled = true
+			c.Archive.Enabled = true
+		}, []string{"rollup.enabled: not supported with sql.driver postgres", "archive.enabled: not supported with sql.driver postgres"}},
+		{"timezone", func(c *Config) { c.Timezone = "Asia/Hanoi_City" }, []string{"timezone: "}},
+		{"enumerations", func(c *Config) {
+			c.Logging.Level, c.Logging.Format, c.Timestamp.Unit = "verbose", "xml", "us"
+			c.UnknownDevice.Policy, c.Authorization.UnknownAction = "drop", "deny"
+		}, []string{
+			`logging.level: "verbose" is not debug, info, warn or error`, `logging.format: "xml" is not text or json`,
+			`timestamp.unit: "us" is not auto, s or ms`, `unknown_device.policy: "drop" is not ignore, warn or create`,
+			`authorization.unknown_action: "deny" is not allow, reject or quarantine`,
+		}},
+		{"regex", func(c *Config) { c.Authorization.DeviceIDPattern = "^T[0-9+$" }, []string{"authorization.device_id_pattern: "}},
+		{"signing without keys", func(c *Config) { c.Signing.Enabled = true }, []string{"signing: key_file or key_table is required when enabled"}},
+		{"signing key table", func(c *Config) { c.Signing.KeyTable = "keys; DROP TABLE rdas_dev" }, []string{"signing.key_table: "}},
+		{"listen", func(c *Config) { c.HTTP.Listen = "8080" }, []string{"http.listen: "}},
+		{"archive run_at", func(c *Config) { c.Archive.Enabled, c.Archive.RunAt = true, "25:00" }, []string{`archive: invalid run_at "25:00", use HH:MM`}},
+		{"totalizer without sensor", func(c *Config) { c.Totalizer.Enabled = true }, []string{"totalizer: neither totalizer1 nor totalizer2 has a sensor"}},
+		{"totalizer options", func(c *Config) {
+			c.Totalizer.Enabled, c.Totalizer.Totalizer1.Sensor, c.Totalizer.Interval = true, 1, time.Minute
+		}, nil},
+	}
+	for _, tt := range tests {
+		c := valid()
+		tt.change(&c)
+		got := validateConfig(c)
+		if len(got) != len(tt.problems) {
+			t.Errorf("%s: problems %q, want %q", tt.name, got, tt.problems)
+			continue
+		}
+		for i, p := range tt.problems {
+			if !strings.HasPrefix(got[i], p) {
+				t.Errorf("%s: problem %q, want %q", tt.name, got[i], p)
+			}
+		}
+	}
+}
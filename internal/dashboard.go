@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The dashboard is rendered on the server and needs nothing but the
+// converter: no scripts, no external CSS, charts are inline SVG.
+
+type dashboardDevice struct {
+	Device
+	Online       bool
+	Errors       int64
+	RecentErrors []DeviceError
+}
+
+type chartSeries struct {
+	Name     string
+	Points   string
+	Min, Max string
+	Last     string
+}
+
+type chartTick struct {
+	X     float64
+	Label string
+}
+
+const (
+	chartWidth  = 800
+	chartHeight = 140
+	// More than a reading per second for 24 hours is not drawn
+	chartMaxReadings = 86400
+)
+
+var dashboardTemplates = template.Must(template.New("dashboard").Parse(`{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    {{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+    <title>{{.Title}}</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; }
+        table { border-collapse: collapse; margin-bottom: 24px; }
+        th, td { border: 1px solid #ddd; padding: 6px 10px; text-align: left; }
+        th { background-color: #f2f2f2; }
+        tr:nth-child(even) { background-color: #f9f9f9; }
+        .online { color: green; font-weight: bold; }
+        .offline { color: #999; }
+        .open { color: red; font-weight: bold; }
+        .error { color: red; }
+        svg { background: #fcfcfc; border: 1px solid #ddd; margin-bottom: 4px; }
+        svg polyline { fill: none; stroke: #1f77b4; stroke-width: 1.5; }
+        svg line { stroke: #eee; }
+        svg text { font-size: 11px; fill: #666; }
+    </style>
+</head>
+<body>
+{{end}}{{define "list"}}{{template "head" .}}    <h1>{{.Title}}</h1>
+    <p>Updated {{.Updated}} &middot; {{.Online}} online / {{len .Devices}} devices &middot; <a href="/status">status</a> &middot; <a href="/metrics">metrics</a></p>
+    <table>
+        <tr><th>Device ID</th><th>Name</th><th>Project</th><th>Status</th><th>Latest data</th><th>Sensor 1</th><th>Sensor 2</th><th>Sensor 3</th><th>Sensor 4</th><th>UnBox</th><th>Main power</th><th>GSM</th><th>Errors</th></tr>
+{{range .Devices}}        <tr>
+            <td><a href="/device/{{.DeviceID}}">{{.DeviceID}}</a></td>
+            <td>{{.Name}}</td>
+            <td>{{.Project}}</td>
+            <td>{{if .Online}}<span class="online">online</span>{{else}}<span class="offline">offline</span>{{end}}</td>
+            <td>{{.LatestData}}</td>
+{{range .Sensors}}            <td>{{.}}</td>
+{{end}}            <td{{if eq .UnBox "O"}} class="open"{{end}}>{{.UnBox}}</td>
+            <td>{{.MainPower}}</td>
+            <td>{{.GSMSignal}}</td>
+            <td{{if .Errors}} class="error"{{end}}>{{.Errors}}</td>
+        </tr>
+{{end}}    </table>
+</body>
+</html>
+{{end}}{{define "device"}}{{template "head" .}}    <p><a href="/">&larr; All devices</a></p>
+    <h1>{{.Device.DeviceID}} &ndash; {{.Device.Name}}</h1>
+    <p>Project {{.Device.Project}} &middot; {{if .Device.Online}}<span class="online">online</span>{{else}}<span class="offline">offline</span>{{end}} &middot; latest data {{.Device.LatestData}} &middot; UnBox <span{{if eq .Device.UnBox "O"}} class="open"{{end}}>{{.Device.UnBox}}</span></p>
+    <h2>Last 24 hours ({{.Readings}} readings)</h2>
+{{range .Charts}}    <h3>{{.Name}}{{if .Last}}: {{.Last}} <small>(min {{.Min}}, max {{.Max}})</small>{{end}}</h3>
+    <svg width="{{$.Width}}" height="{{$.Height}}" viewBox="0 0 {{$.Width}} {{$.Height}}">
+{{range $.Ticks}}        <line x1="{{.X}}" y1="0" x2="{{.X}}" y2="{{$.Height}}"/><text x="{{.X}}" y="{{$.Height}}" dy="-3" dx="3">{{.Label}}</text>
+{{end}}        <polyline points="{{.Points}}"/>
+    </svg>
+{{end}}    <h2>Recent errors</h2>
+{{if .Device.RecentErrors}}    <table>
+        <tr><th>Time</th><th>Topic</th><th>Result</th></tr>
+{{range .Device.RecentErrors}}        <tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Topic}}</td><td class="error">{{.Results}}</td></tr>
+{{end}}    </table>
+{{else}}    <p>None since {{.Started}}.</p>
+{{end}}</body>
+</html>
+{{end}}`))
+
+func registerDashboard(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		devices, err := dashboardDevices("")
+		if err != nil {
+			slog.Error("Loading dashboard devices failed", "error", err)
+			http.Error(w, "loading devices failed", http.StatusInternalServerError)
+			return
+		}
+		online := 0
+		for _, d := range devices {
+			if d.Online {
+				online++
+			}
+		}
+		renderDashboard(w, "list", struct {
+			Title, Updated  string
+			Refresh, Online int
+			Devices         []dashboardDevice
+		}{"Devices", localNow().Format("2006-01-02 15:04:05"), 30, online, devices})
+	})
+
+	mux.HandleFunc("GET /device/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		devices, err := dashboardDevices(id)
+		if err != nil {
+			slog.Error("Loading dashboard device failed", "deviceID", id, "error", err)
+			http.Error(w, "loading device failed", http.StatusInternalServerError)
+			return
+		}
+		if len(devices) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		to := localNow()
+		from := to.Add(-24 * time.Hour)
+		readings, err := store.History(id, from, to, chartMaxReadings, 0)
+		if err != nil {
+			slog.Error("Loading sensor history failed", "deviceID", id, "error", err)
+			http.Error(w, "loading sensor history failed", http.StatusInternalServerError)
+			return
+		}
+		renderDashboard(w, "device", struct {
+			Title, Started string
+			Refresh        int
+			Device         dashboardDevice
+			Readings       int
+			Charts         []chartSeries
+			Ticks          []chartTick
+			Width, Height  int
+		}{
+			Title:    "Device " + id,
+			Started:  stats.started.In(location).Format("2006-01-02 15:04:05"),
+			Refresh:  60,
+			Device:   devices[0],
+			Readings: len(readings),
+			Charts:   sensorCharts(readings, from, to),
+			Ticks:    chartTicks(from, to),
+			Width:    chartWidth,
+			Height:   chartHeight,
+		})
+	})
+}
+
+func renderDashboard(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := dashboardTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		slog.Error("Rendering dashboard failed", "page", name, "error", err)
+		http.Error(w, "rendering failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// dashboardDevices reads the devices from rdas_dev, or only deviceID when it
+// is not empty, and adds the errors seen since start.
+func dashboardDevices(deviceID string) ([]dashboardDevice, error) {
+	devices, err := store.Devices(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	_, seen := stats.snapshot()
+	byID := make(map[string]DeviceStats, len(seen))
+	for _, d := range seen {
+		byID[d.DeviceID] = d
+	}
+	now := localNow()
+	out := make([]dashboardDevice, len(devices))
+	for i, d := range devices {
+		out[i].Device = d
+		if t, err := time.ParseInLocation(sqlDateTime, d.LatestData, location); err == nil {
+			out[i].Online = now.Sub(t) <= offlineAfter
+		}
+		if s, ok := byID[d.DeviceID]; ok {
+			out[i].Errors = s.Errors
+			out[i].RecentErrors = s.RecentErrors
+		}
+	}
+	return out, nil
+}
+
+// sensorCharts scales each sensor channel to its own chart.
+func sensorCharts(readings []Reading, from, to time.Time) []chartSeries {
+	names := []string{"Sensor 1 (pressure1)", "Sensor 2 (level1)", "Sensor 3 (pressure2)", "Sensor 4 (level2)"}
+	span := to.Sub(from).Seconds()
+	charts := make([]chartSeries, len(names))
+	for ch, name := range names {
+		charts[ch].Name = name
+		if len(readings) == 0 {
+			continue
+		}
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, r := range readings {
+			lo = math.Min(lo, r.Sensors[ch])
+			hi = math.Max(hi, r.Sensors[ch])
+		}
+		rangeY := hi - lo
+		if rangeY == 0 {
+			rangeY = 1
+		}
+		points := make([]string, len(readings))
+		for i, r := range readings {
+			x := r.Time.Sub(from).Seconds() / span * chartWidth
+			// 10px margin at the top, 16px at the bottom for the time labels
+			y := 10 + (1-(r.Sensors[ch]-lo)/rangeY)*(chartHeight-26)
+			points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+		}
+		charts[ch].Points = strings.Join(points, " ")
+		charts[ch].Min = formatNumber(lo)
+		charts[ch].Max = formatNumber(hi)
+		charts[ch].Last = formatNumber(readings[len(readings)-1].Sensors[ch])
+	}
+	return charts
+}
+
+// chartTicks returns a vertical grid line every 3 hours.
+func chartTicks(from, to time.Time) []chartTick {
+	span := to.Sub(from).Seconds()
+	var ticks []chartTick
+	t := from.Truncate(time.Hour).Add(time.Hour)
+	for ; t.Before(to); t = t.Add(time.Hour) {
+		if t.Hour()%3 != 0 {
+			continue
+		}
+		ticks = append(ticks, chartTick{X: math.Round(t.Sub(from).Seconds()/span*chartWidth*10) / 10, Label: t.Format("15:04")})
+	}
+	return ticks
+}
@@ -1,18 +1,22 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
+	"net"
+	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 type Config struct {
@@ -21,60 +25,241 @@ type Config struct {
 		Port     int    `yaml:"port"`
 		User     string `yaml:"user"`
 		Pass     string `yaml:"pass"`
+		PassFile string `yaml:"pass_file"`
 		Protocol string `yaml:"protocol"`
 		Topic    string `yaml:"topic"`
 	} `yaml:"mqtt"`
 	SQL struct {
-		Host   string `yaml:"host"`
-		Port   int    `yaml:"port"`
-		User   string `yaml:"user"`
-		Pass   string `yaml:"pass"`
-		Dbname string `yaml:"dbname"`
+		Driver    string `yaml:"driver"` // mysql, postgres
+		Host      string `yaml:"host"`
+		Port      int    `yaml:"port"`
+		User      string `yaml:"user"`
+		Pass      string `yaml:"pass"`
+		PassFile  string `yaml:"pass_file"`
+		Dbname    string `yaml:"dbname"`
+		SSLMode   string `yaml:"sslmode"`   // postgres only
+		Timescale bool   `yaml:"timescale"` // postgres only: sensor_data as a TimescaleDB hypertable
 	} `yaml:"sql"`
+	Dedup struct {
+		Enabled     bool `yaml:"enabled"`
+		CacheSize   int  `yaml:"cache_size"`
+		UniqueIndex bool `yaml:"unique_index"`
+	} `yaml:"dedup"`
+	Timezone      string `yaml:"timezone"`
+	UnknownDevice struct {
+		Policy   string         `yaml:"policy"`
+		Template DeviceTemplate `yaml:"template"`
+	} `yaml:"unknown_device"`
+	Authorization struct {
+		Enabled         bool          `yaml:"enabled"`
+		DeviceIDPattern string        `yaml:"device_id_pattern"`
+		UnknownAction   string        `yaml:"unknown_action"`
+		DisabledAction  string        `yaml:"disabled_action"`
+		DisabledDevices []string      `yaml:"disabled_devices"`
+		RefreshInterval time.Duration `yaml:"refresh_interval"`
+		QuarantineLog   string        `yaml:"quarantine_log"`
+	} `yaml:"authorization"`
+	Signing struct {
+		Enabled         bool          `yaml:"enabled"`
+		Required        bool          `yaml:"required"`
+		KeyFile         string        `yaml:"key_file"`
+		KeyTable        string        `yaml:"key_table"`
+		RefreshInterval time.Duration `yaml:"refresh_interval"`
+		RejectionLog    string        `yaml:"rejection_log"`
+	} `yaml:"signing"`
+	DeviceLog struct {
+		Dir           string        `yaml:"dir"`
+		Formats       []string      `yaml:"formats"`
+		MaxFileSizeMB int           `yaml:"max_file_size_mb"`
+		MaxOpenFiles  int           `yaml:"max_open_files"`
+		FlushInterval time.Duration `yaml:"flush_interval"`
+		Retention     LogRetention  `yaml:"retention"`
+	} `yaml:"device_log"`
+	HTTP struct {
+		Listen       string        `yaml:"listen"`
+		OfflineAfter time.Duration `yaml:"offline_after"`
+		Dashboard    bool          `yaml:"dashboard"`
+		Stream       bool          `yaml:"stream"`
+		API          bool          `yaml:"api"`
+		Grafana      bool          `yaml:"grafana"`
+		Token        string        `yaml:"token"`
+		// Origins of pages on other hosts that may open /stream/ws
+		AllowedOrigins []string `yaml:"allowed_origins"`
+	} `yaml:"http"`
+	Rollup struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"rollup"`
+	Archive   ArchiveConfig   `yaml:"archive"`
+	Totalizer TotalizerConfig `yaml:"totalizer"`
+	Logging   struct {
+		Level  string `yaml:"level"`  // debug, info, warn, error
+		Format string `yaml:"format"` // text, json
+	} `yaml:"logging"`
+	Timestamp struct {
+		Unit          string        `yaml:"unit"`
+		MaxPast       time.Duration `yaml:"max_past"`
+		MaxFuture     time.Duration `yaml:"max_future"`
+		SubstituteBad bool          `yaml:"substitute_bad"`
+		DriftWarn     time.Duration `yaml:"drift_warn"`
+	} `yaml:"timestamp"`
 }
 
 func SetupDatabase(config Config) *sql.DB {
-	log.Println("Connecting to database...")
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", config.SQL.User, config.SQL.Pass, config.SQL.Host, config.SQL.Port, config.SQL.Dbname)
+	slog.Info("Connecting to database...", "driver", config.SQL.Driver)
+	switch config.SQL.Driver {
+	case "", "mysql":
+		sqlDriver = "mysql"
+	case "postgres":
+		sqlDriver = "postgres"
+	default:
+		slog.Error("Unknown sql.driver, use mysql or postgres", "driver", config.SQL.Driver)
+		os.Exit(1)
+	}
+	dsn := databaseDSN(config, config.SQL.Pass)
+	slog.Debug("Database DSN", "dsn", databaseDSN(config, redactedSecret))
 	var db *sql.DB
 	for {
 		var err error
-		db, err = sql.Open("mysql", dsn)
+		db, err = openDatabase(dsn)
 		if err != nil {
-			log.Printf("Database connection failed: %v. Retrying in 10 seconds...", err)
+			slog.Error("Database connection failed, retrying in 10 seconds", "error", err)
 			time.Sleep(10 * time.Second)
 			continue
 		}
 		err = db.Ping()
 		if err != nil {
-			log.Printf("Database ping failed: %v. Retrying in 10 seconds...", err)
+			slog.Error("Database ping failed, retrying in 10 seconds", "error", err)
 			db.Close()
 			time.Sleep(10 * time.Second)
 			continue
 		}
-		log.Println("Connected to database successfully.")
+		slog.Info("Connected to database successfully.")
+		if sqlDriver == "postgres" {
+			store = &postgresStore{db: db}
+		} else {
+			store = &mysqlStore{db: db}
+		}
+		lifetime := 30 * 24 * time.Hour // Tăng lên 1 tháng để đồng bộ với MQTT
+		if sqlDriver == "mysql" {
+			lifetime = setupMySQLTimeZone(db, lifetime)
+		}
 		// Tối ưu connection pool
 		db.SetMaxOpenConns(10)
 		db.SetMaxIdleConns(5)
-		db.SetConnMaxLifetime(30 * 24 * time.Hour) // Tăng lên 1 tháng để đồng bộ với MQTT
+		db.SetConnMaxLifetime(lifetime)
 		break
 	}
 	return db
 }
 
-func ProcessTelemetryMessage(db *sql.DB, msg mqtt.Message) {
+// openDatabase opens dsn. MySQL sessions get their time_zone when each
+// connection is opened rather than once from the DSN, so that connections
+// opened after a DST change get the new offset.
+func openDatabase(dsn string) (*sql.DB, error) {
+	if sqlDriver != "mysql" {
+		return sql.Open(sqlDriver, dsn)
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Apply(mysql.BeforeConnect(func(ctx context.Context, c *mysql.Config) error {
+		c.Params["time_zone"] = "'" + mysqlTimeZone() + "'"
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// databaseDSN builds the DSN for sqlDriver with the given password, so that
+// it can also be built for the log with the password redacted.
+func databaseDSN(config Config, pass string) string {
+	if sqlDriver == "postgres" {
+		return postgresDSN(config, pass)
+	}
+	// clientFoundRows makes RowsAffected count matched rows, so an UPDATE that
+	// leaves values unchanged is not mistaken for a skipped one. time_zone makes
+	// NOW() agree with the datetimes formatted in the configured timezone.
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?clientFoundRows=true&time_zone=%s", config.SQL.User, pass, config.SQL.Host, config.SQL.Port, config.SQL.Dbname, url.QueryEscape("'"+mysqlOffset()+"'"))
+}
+
+// postgresDSN builds a lib/pq connection URL. UPDATE counts matched rows on
+// PostgreSQL anyway; TimeZone plays the role of the MySQL time_zone.
+func postgresDSN(config Config, pass string) string {
+	port := config.SQL.Port
+	if port == 0 {
+		port = 5432
+	}
+	q := url.Values{}
+	if config.SQL.SSLMode != "" {
+		q.Set("sslmode", config.SQL.SSLMode)
+	}
+	if name := zoneName(); name != "" {
+		q.Set("TimeZone", name)
+	} else {
+		// POSIX offsets count hours west of UTC, the opposite sign
+		offset := mysqlOffset()
+		if offset[0] == '+' {
+			offset = "-" + offset[1:]
+		} else {
+			offset = "+" + offset[1:]
+		}
+		q.Set("TimeZone", "UTC"+offset)
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(config.SQL.User, pass),
+		Host:     net.JoinHostPort(config.SQL.Host, strconv.Itoa(port)),
+		Path:     "/" + config.SQL.Dbname,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// ProcessTelemetryMessage writes the readings of a telemetry message and
+// reports whether every one of them was stored (or was a duplicate) and the
+// message was neither refused nor quarantined.
+func ProcessTelemetryMessage(db *sql.DB, msg mqtt.Message) bool {
+	received := localNow()
+	var results messageLog
 	payload := msg.Payload()
 	originalPayload := string(payload) // Keep original for logging
 
 	// Extract deviceID from topic first
 	parts := strings.Split(msg.Topic(), "/")
 	if len(parts) < 3 {
-		log.Printf("Invalid topic format: %s", msg.Topic())
-		WriteHTMLLog(msg.Topic(), originalPayload, "unknown", 0, 0, 0, 0, time.Now().Format("2006-01-02 15:04:05"), "INVALID TOPIC", "N/A", "N/A", 0, 0, 0, 0, "")
-		return
+		slog.Warn("Invalid topic format", "topic", msg.Topic())
+		quarantineMessage(db, msg.Topic(), "", payload, "invalid topic")
+		results.write(LogEntry{
+			Topic:        msg.Topic(),
+			Payload:      originalPayload,
+			ReadingTime:  localNow().Format("2006-01-02 15:04:05"),
+			InsertResult: "INVALID TOPIC",
+			UpdateResult: "N/A",
+			AlertResult:  "N/A",
+		})
+		return false
 	}
 	deviceID := parts[2]
 
+	if !authorizeDevice(db, msg.Topic(), deviceID, payload) {
+		return false
+	}
+
+	// Signed payloads are verified and unwrapped before anything is written
+	payload, ok := verifyPayload(msg.Topic(), deviceID, payload)
+	if !ok {
+		return false
+	}
+	stats.deviceMessage(msg.Topic(), deviceID)
+	originalPayload = string(payload)
+
 	var data []map[string]interface{}
 	var err error
 
@@ -85,18 +270,32 @@ func ProcessTelemetryMessage(db *sql.DB, msg mqtt.Message) {
 			key := strings.TrimSuffix(match, ":")
 			return "\"" + key + "\":"
 		})
-		log.Printf("Fixed old format payload: %s", fixedPayload)
+		slog.Debug("Fixed old format payload", "deviceID", deviceID, "payload", fixedPayload)
 		err = json.Unmarshal([]byte(fixedPayload), &data)
 	} else {
 		// New format: direct parse
-		log.Printf("Payload: %s", originalPayload)
+		slog.Debug("Payload", "deviceID", deviceID, "payload", originalPayload)
 		err = json.Unmarshal(payload, &data)
 	}
 
 	if err != nil {
-		log.Printf("Error parsing JSON: %v", err)
-		WriteHTMLLog(msg.Topic(), originalPayload, deviceID, 0, 0, 0, 0, time.Now().Format("2006-01-02 15:04:05"), "PARSE ERROR", "N/A", "N/A", 0, 0, 0, 0, "")
-		return
+		slog.Warn("Parsing telemetry JSON failed", "deviceID", deviceID, "topic", msg.Topic(), "error", err)
+		metricParseErrors.inc("telemetry")
+		quarantineMessage(db, msg.Topic(), deviceID, payload, "parse error: "+err.Error())
+		results.write(LogEntry{
+			Topic:        msg.Topic(),
+			DeviceID:     deviceID,
+			Payload:      originalPayload,
+			ReadingTime:  localNow().Format("2006-01-02 15:04:05"),
+			InsertResult: "PARSE ERROR",
+			UpdateResult: "N/A",
+			AlertResult:  "N/A",
+		})
+		return false
+	}
+
+	if newest := newestTimestamp(data); newest > 0 {
+		recordDrift(deviceID, newest, received)
 	}
 
 	for _, item := range data {
@@ -133,43 +332,57 @@ func ProcessTelemetryMessage(db *sql.DB, msg mqtt.Message) {
 			}
 			unBox := string(unBoxStr[0]) // Take first character
 
-			dt := time.Unix(int64(ts)/1000, (int64(ts)%1000)*int64(time.Millisecond))
+			dt, tsNote, ok := readingTime(ts, received)
+			if !ok {
+				slog.Warn("Rejected UnBox reading", "deviceID", deviceID, "reason", tsNote)
+				results.write(LogEntry{
+					Topic:        msg.Topic(),
+					DeviceID:     deviceID,
+					Payload:      originalPayload,
+					ReadingTime:  dt.Format("2006-01-02 15:04:05"),
+					UnBox:        unBox,
+					InsertResult: "N/A",
+					UpdateResult: "TIMESTAMP REJECTED - " + tsNote,
+					AlertResult:  "N/A",
+				})
+				continue
+			}
+			if tsNote != "" {
+				slog.Warn("Reading timestamp adjusted", "deviceID", deviceID, "note", tsNote)
+			}
 			dtStr := dt.Format("2006-01-02 15:04:05")
-			log.Printf("Parsed UnBox: %s, timestamp=%s, deviceID=%s", unBox, dtStr, deviceID)
-
-			var updateResult string
+			slog.Debug("Parsed UnBox", "deviceID", deviceID, "unbox", unBox, "timestamp", dtStr)
 
 			// Update rdas_dev table
-			updateQuery := fmt.Sprintf("UPDATE rdas_dev SET status = NOW(), LatestData = '%s', Type = 'MQTT', UnBox = '%s' WHERE devID = '%s'", dtStr, unBox, deviceID)
-			log.Printf("Executing UPDATE SQL: %s", updateQuery)
-			_, err = db.Exec(updateQuery)
-			if err != nil {
-				log.Printf("Error executing UPDATE for rdas_dev: %v", err)
-				updateResult = "UPDATE rdas_dev: FAILED - " + err.Error()
-			} else {
-				log.Printf("Updated rdas_dev for device %s", deviceID)
-				updateResult = "UPDATE rdas_dev: SUCCESS"
-			}
+			updateResult := updateRealtime(deviceID, DeviceState{LatestData: &dt, UnBox: unBox})
 
 			// If UnBox is "O", insert into alert table
 			alertResult := "N/A"
 			if unBox == "O" {
-				alertTimeStr := dt.Format("15:04:05 02_01_2006")
-				description := fmt.Sprintf("Device>Urgent:CANH BAO MO TU LUC %s!!!!", alertTimeStr)
-				alertQuery := fmt.Sprintf("INSERT INTO alert (EventTime, InsertTime, Source, Priority, Description, AlertType, Project, Type, Status, Note) VALUES ('%s', NOW(), '%s', 1, '%s', 'Device', 'SOVIGAZ', 'Alert', 'V', '')", dtStr, deviceID, description)
-				log.Printf("Executing ALERT SQL: %s", alertQuery)
-				_, err = db.Exec(alertQuery)
+				description := unBoxAlertDescription(dt)
+				err = store.InsertAlert(Alert{EventTime: dt, Source: deviceID, Priority: 1, Description: description, Project: "SOVIGAZ"})
 				if err != nil {
-					log.Printf("Error executing INSERT for alert: %v", err)
 					alertResult = "INSERT alert: FAILED - " + err.Error()
 				} else {
-					log.Printf("Inserted alert for device %s", deviceID)
+					slog.Info("Inserted alert", "deviceID", deviceID)
+					metricAlerts.inc("unbox_open")
 					alertResult = "INSERT alert: SUCCESS"
+					hub.publish(StreamEvent{Type: "alert", DeviceID: deviceID, Topic: msg.Topic(), ReadingTime: dtStr, UnBox: unBox, Alert: description})
 				}
 			}
+			hub.publish(StreamEvent{Type: "reading", DeviceID: deviceID, Topic: msg.Topic(), ReadingTime: dtStr, UnBox: unBox})
 
 			// Log to HTML file
-			WriteHTMLLog(msg.Topic(), originalPayload, deviceID, 0, 0, 0, 0, dtStr, "N/A", updateResult, alertResult, 0, 0, 0, 0, unBox)
+			results.write(LogEntry{
+				Topic:        msg.Topic(),
+				DeviceID:     deviceID,
+				Payload:      originalPayload,
+				ReadingTime:  dtStr,
+				UnBox:        unBox,
+				InsertResult: "N/A",
+				UpdateResult: updateResult,
+				AlertResult:  alertResult,
+			})
 			continue // Skip to next item
 		}
 
@@ -207,80 +420,203 @@ func ProcessTelemetryMessage(db *sql.DB, msg mqtt.Message) {
 		sensor3 = math.Round(sensor3/1000*10000) / 10000
 		sensor4 = math.Round(sensor4/1000*10000) / 10000
 
-		dt := time.Unix(int64(ts)/1000, (int64(ts)%1000)*int64(time.Millisecond))
+		dt, tsNote, ok := readingTime(ts, received)
+		if !ok {
+			slog.Warn("Rejected reading", "deviceID", deviceID, "reason", tsNote)
+			results.write(LogEntry{
+				Topic:        msg.Topic(),
+				DeviceID:     deviceID,
+				Payload:      originalPayload,
+				ReadingTime:  dt.Format("2006-01-02 15:04:05"),
+				Sensors:      [4]float64{sensor1, sensor2, sensor3, sensor4},
+				UnBox:        unBox,
+				InsertResult: "TIMESTAMP REJECTED - " + tsNote,
+				UpdateResult: "N/A",
+				AlertResult:  "N/A",
+			})
+			continue
+		}
+		if tsNote != "" {
+			slog.Warn("Reading timestamp adjusted", "deviceID", deviceID, "note", tsNote)
+		}
 		dtStr := dt.Format("2006-01-02 15:04:05")
 
-		// If UnBox is "O", insert into alert table
-		if unBox == "O" {
-			alertTimeStr := dt.Format("15:04:05 02_01_2006")
-			description := fmt.Sprintf("Device>Urgent:CANH BAO MO TU LUC %s!!!!", alertTimeStr)
-			alertQuery := fmt.Sprintf("INSERT INTO alert (EventTime, InsertTime, Source, Priority, Description, AlertType, Project, Type, Status, Note) VALUES ('%s', NOW(), '%s', 1, '%s', 'Device', 'SOVIGAZ', 'Alert', 'V', '')", dtStr, deviceID, description)
-			log.Printf("Executing ALERT SQL: %s", alertQuery)
-			_, err = db.Exec(alertQuery)
-			if err != nil {
-				log.Printf("Error executing INSERT for alert: %v", err)
-			} else {
-				log.Printf("Inserted alert for device %s", deviceID)
-			}
+		// Resent frames from the device buffer are dropped before any write
+		if isDuplicateReading(deviceID, int64(ts)) {
+			countDuplicate(deviceID, int64(ts), "cache")
+			results.write(LogEntry{
+				Topic:        msg.Topic(),
+				DeviceID:     deviceID,
+				Payload:      originalPayload,
+				ReadingTime:  dtStr,
+				Sensors:      [4]float64{sensor1, sensor2, sensor3, sensor4},
+				UnBox:        unBox,
+				InsertResult: "INSERT sensor_data: DUPLICATE - skipped",
+				UpdateResult: "N/A",
+				AlertResult:  "N/A",
+			})
+			continue
 		}
 
-		log.Printf("Parsed values: sensor1=%.2f, sensor2=%.2f, sensor3=%.2f, sensor4=%.2f, timestamp=%s, deviceID=%s", sensor1, sensor2, sensor3, sensor4, dtStr, deviceID)
+		slog.Debug("Parsed values", "deviceID", deviceID, "sensor1", sensor1, "sensor2", sensor2, "sensor3", sensor3, "sensor4", sensor4, "timestamp", dtStr)
 
 		var insertResult, updateResult string
 		alertResult := "N/A"
 
-		sqlQuery := fmt.Sprintf("INSERT INTO sensor_data (deviceID, status, sensor1, sensor2, sensor3, sensor4, sensor5, sensor6, sensor7, sensor8, SensorPowerStatus, GSMSignal, `Current_timestamp`, date_time, UnBox) VALUES ('%s', 'active', %f, %f, %f, %f, 0, 0, 0, 0, 'ON', 0, NOW(), '%s', '%s')", deviceID, sensor1, sensor2, sensor3, sensor4, dtStr, unBox)
-		log.Printf("Executing SQL: %s", sqlQuery)
-		_, err := db.Exec(sqlQuery)
+		sensors := [4]float64{sensor1, sensor2, sensor3, sensor4}
+		inserted, err := store.InsertReading(Reading{DeviceID: deviceID, Time: dt, Sensors: sensors, UnBox: unBox}, dedupUseIndex)
 		if err != nil {
-			log.Printf("Error executing SQL for sensor_data: %v", err)
 			insertResult = "INSERT sensor_data: FAILED - " + err.Error()
+			forgetReading(deviceID, int64(ts))
+		} else if !inserted {
+			countDuplicate(deviceID, int64(ts), "unique index")
+			results.write(LogEntry{
+				Topic:        msg.Topic(),
+				DeviceID:     deviceID,
+				Payload:      originalPayload,
+				ReadingTime:  dtStr,
+				Sensors:      [4]float64{sensor1, sensor2, sensor3, sensor4},
+				UnBox:        unBox,
+				InsertResult: "INSERT sensor_data: DUPLICATE - skipped",
+				UpdateResult: "N/A",
+				AlertResult:  alertResult,
+			})
+			continue
 		} else {
-			log.Printf("Inserted sensor data for device %s at %s", deviceID, dtStr)
+			slog.Debug("Inserted sensor data", "deviceID", deviceID, "timestamp", dtStr)
+			stats.count("inserted")
 			insertResult = "INSERT sensor_data: SUCCESS"
 		}
 
+		// If UnBox is "O", insert into alert table
+		if unBox == "O" {
+			description := unBoxAlertDescription(dt)
+			if err := store.InsertAlert(Alert{EventTime: dt, Source: deviceID, Priority: 1, Description: description, Project: "SOVIGAZ"}); err == nil {
+				slog.Info("Inserted alert", "deviceID", deviceID)
+				metricAlerts.inc("unbox_open")
+				hub.publish(StreamEvent{Type: "alert", DeviceID: deviceID, Topic: msg.Topic(), ReadingTime: dtStr, UnBox: unBox, Alert: description})
+			}
+		}
+
 		// Update rdas_dev table
-		var updates []string
-		updates = append(updates, fmt.Sprintf("status = NOW(), LatestData = '%s', Current_ss1 = %f, Current_ss2 = %f, Current_ss3 = %f, Current_ss4 = %f, Type = 'MQTT'", dtStr, sensor1, sensor2, sensor3, sensor4))
+		state := DeviceState{LatestData: &dt, Sensors: &sensors}
 		if hasUnBox {
-			updates = append(updates, fmt.Sprintf("UnBox = '%s'", unBox))
+			state.UnBox = unBox
 		}
-		updateQuery := fmt.Sprintf("UPDATE rdas_dev SET %s WHERE devID = '%s'", strings.Join(updates, ", "), deviceID)
-		log.Printf("Executing UPDATE SQL: %s", updateQuery)
-		_, err = db.Exec(updateQuery)
-		if err != nil {
-			log.Printf("Error executing UPDATE for rdas_dev: %v", err)
-			updateResult = "UPDATE rdas_dev: FAILED - " + err.Error()
-		} else {
-			log.Printf("Updated rdas_dev for device %s", deviceID)
-			updateResult = "UPDATE rdas_dev: SUCCESS"
+		updateResult = updateRealtime(deviceID, state)
+		// Readings that were stored are streamed to live subscribers
+		if err == nil {
+			hub.publish(StreamEvent{Type: "reading", DeviceID: deviceID, Topic: msg.Topic(), ReadingTime: dtStr, Sensors: &sensors, UnBox: unBox})
 		}
 
 		// Log to HTML file
-		WriteHTMLLog(msg.Topic(), originalPayload, deviceID, sensor1, sensor2, sensor3, sensor4, dtStr, insertResult, updateResult, alertResult, 0, 0, 0, 0, unBox)
+		results.write(LogEntry{
+			Topic:        msg.Topic(),
+			DeviceID:     deviceID,
+			Payload:      originalPayload,
+			ReadingTime:  dtStr,
+			Sensors:      [4]float64{sensor1, sensor2, sensor3, sensor4},
+			UnBox:        unBox,
+			InsertResult: insertResult,
+			UpdateResult: updateResult,
+			AlertResult:  alertResult,
+		})
 	}
+	return !results.failed
+}
+
+func unBoxAlertDescription(dt time.Time) string {
+	return fmt.Sprintf("Device>Urgent:CANH BAO MO TU LUC %s!!!!", dt.Format("15:04:05 02_01_2006"))
 }
 
-func ProcessAttributesMessage(db *sql.DB, msg mqtt.Message) {
+// updateRealtime applies state to the device's rdas_dev row only if the
+// reading is not older than the stored LatestData, so a late frame from the
+// device buffer cannot overwrite newer realtime values. Equal timestamps are
+// still applied because an UnBox-only frame may share ts with sensor values.
+func updateRealtime(deviceID string, state DeviceState) string {
+	n, err := store.UpdateDevice(deviceID, state)
+	if err != nil {
+		return "UPDATE rdas_dev: FAILED - " + err.Error()
+	}
+	if n == 0 {
+		latest, exists, err := store.LatestData(deviceID)
+		switch {
+		case err != nil:
+			slog.Error("Reading LatestData failed", "deviceID", deviceID, "error", err)
+			return "UPDATE rdas_dev: FAILED - " + err.Error()
+		case !exists:
+			return retryForNewDevice(deviceID, state)
+		}
+		slog.Info("Skipped rdas_dev update, reading is older than LatestData", "deviceID", deviceID, "timestamp", state.LatestData.Format(sqlDateTime), "latestData", latest)
+		return fmt.Sprintf("UPDATE rdas_dev: SKIPPED - older than LatestData %s", latest)
+	}
+	slog.Debug("Updated rdas_dev", "deviceID", deviceID)
+	return "UPDATE rdas_dev: SUCCESS"
+}
+
+// retryForNewDevice handles an UPDATE that found no rdas_dev row for the
+// device, re-running it if the unknown device policy created the row.
+func retryForNewDevice(deviceID string, state DeviceState) string {
+	if !ensureDevice(deviceID) {
+		return "UPDATE rdas_dev: UNKNOWN DEVICE - no rdas_dev row"
+	}
+	if _, err := store.UpdateDevice(deviceID, state); err != nil {
+		return "UPDATE rdas_dev: FAILED - " + err.Error()
+	}
+	slog.Info("Updated rdas_dev for new device", "deviceID", deviceID)
+	return "UPDATE rdas_dev: SUCCESS (new device)"
+}
+
+// ProcessAttributesMessage updates rdas_dev from an attributes message and
+// reports whether the update succeeded.
+func ProcessAttributesMessage(db *sql.DB, msg mqtt.Message) bool {
 	payload := msg.Payload()
-	log.Printf("Processing attributes message: %s", string(payload))
+	var results messageLog
+	slog.Debug("Processing attributes message", "topic", msg.Topic(), "payload", string(payload))
 
 	// Extract deviceID from topic first
 	parts := strings.Split(msg.Topic(), "/")
 	if len(parts) < 3 {
-		log.Printf("Invalid topic format for attributes: %s", msg.Topic())
-		WriteHTMLLog(msg.Topic(), string(payload), "unknown", 0, 0, 0, 0, time.Now().Format("2006-01-02 15:04:05"), "N/A", "INVALID TOPIC", "N/A", 0, 0, 0, 0, "")
-		return
+		slog.Warn("Invalid topic format for attributes", "topic", msg.Topic())
+		quarantineMessage(db, msg.Topic(), "", payload, "invalid topic")
+		results.write(LogEntry{
+			Topic:        msg.Topic(),
+			Payload:      string(payload),
+			ReadingTime:  localNow().Format("2006-01-02 15:04:05"),
+			InsertResult: "N/A",
+			UpdateResult: "INVALID TOPIC",
+			AlertResult:  "N/A",
+		})
+		return false
 	}
 	deviceID := parts[2]
 
+	if !authorizeDevice(db, msg.Topic(), deviceID, payload) {
+		return false
+	}
+
+	payload, ok := verifyPayload(msg.Topic(), deviceID, payload)
+	if !ok {
+		return false
+	}
+	stats.deviceMessage(msg.Topic(), deviceID)
+
 	var attributes map[string]interface{}
 	err := json.Unmarshal(payload, &attributes)
 	if err != nil {
-		log.Printf("Error parsing attributes JSON: %v", err)
-		WriteHTMLLog(msg.Topic(), string(payload), deviceID, 0, 0, 0, 0, time.Now().Format("2006-01-02 15:04:05"), "N/A", "PARSE ERROR", "N/A", 0, 0, 0, 0, "")
-		return
+		slog.Warn("Parsing attributes JSON failed", "deviceID", deviceID, "topic", msg.Topic(), "error", err)
+		metricParseErrors.inc("attributes")
+		quarantineMessage(db, msg.Topic(), deviceID, payload, "parse error: "+err.Error())
+		results.write(LogEntry{
+			Topic:        msg.Topic(),
+			DeviceID:     deviceID,
+			Payload:      string(payload),
+			ReadingTime:  localNow().Format("2006-01-02 15:04:05"),
+			InsertResult: "N/A",
+			UpdateResult: "PARSE ERROR",
+			AlertResult:  "N/A",
+		})
+		return false
 	}
 
 	// Initialize attribute values
@@ -291,57 +627,76 @@ func ProcessAttributesMessage(db *sql.DB, msg mqtt.Message) {
 	var unBox string
 
 	// Map attributes to database fields
-	var updates []string
+	var state DeviceState
 
 	if mainPowerStr, ok := attributes["main_power"].(string); ok {
 		if mp, err := strconv.ParseFloat(mainPowerStr, 64); err == nil {
 			mainPower = mp
-			updates = append(updates, fmt.Sprintf("MainPower = %f", mainPower))
+			state.MainPower = &mainPower
 		} else {
-			log.Printf("Error parsing main_power '%s' to float: %v", mainPowerStr, err)
+			slog.Warn("Parsing main_power failed", "deviceID", deviceID, "value", mainPowerStr, "error", err)
 		}
 	}
 
 	if gs, ok := attributes["GSM_Signal"].(float64); ok {
 		gsmSignal = int(gs)
-		updates = append(updates, fmt.Sprintf("GSMSignal = %d", gsmSignal))
+		state.GSMSignal = &gsmSignal
 	}
 
 	if sr, ok := attributes["SamplingRate"].(float64); ok {
 		sampleTime = int(sr)
-		updates = append(updates, fmt.Sprintf("sample_time = %d", sampleTime))
+		state.SampleTime = &sampleTime
 	}
 
 	if sdr, ok := attributes["SendingRate"].(float64); ok {
 		sendingRate = int(sdr)
-		updates = append(updates, fmt.Sprintf("SendingRate = %d", sendingRate))
+		state.SendingRate = &sendingRate
 	}
 
 	if ub, ok := attributes["UnBox"].(string); ok && len(ub) > 0 {
 		unBox = string(ub[0])
-		updates = append(updates, fmt.Sprintf("UnBox = '%s'", unBox))
+		state.UnBox = unBox
 	}
 
-	if len(updates) == 0 {
-		log.Printf("No valid attributes to update for device %s", deviceID)
-		WriteHTMLLog(msg.Topic(), string(payload), deviceID, 0, 0, 0, 0, time.Now().Format("2006-01-02 15:04:05"), "N/A", "NO VALID ATTRIBUTES", "N/A", 0, 0, 0, 0, "")
-		return
+	if state == (DeviceState{}) {
+		slog.Warn("No valid attributes to update", "deviceID", deviceID)
+		results.write(LogEntry{
+			Topic:        msg.Topic(),
+			DeviceID:     deviceID,
+			Payload:      string(payload),
+			ReadingTime:  localNow().Format("2006-01-02 15:04:05"),
+			InsertResult: "N/A",
+			UpdateResult: "NO VALID ATTRIBUTES",
+			AlertResult:  "N/A",
+		})
+		return false
 	}
 
-	updates = append(updates, "Type = 'MQTT'")
-
-	updateQuery := fmt.Sprintf("UPDATE rdas_dev SET %s WHERE devID = '%s'", strings.Join(updates, ", "), deviceID)
-	log.Printf("Executing UPDATE SQL for attributes: %s", updateQuery)
-	_, err = db.Exec(updateQuery)
+	n, err := store.UpdateDevice(deviceID, state)
 	var updateResult string
 	if err != nil {
-		log.Printf("Error executing UPDATE for rdas_dev attributes: %v", err)
 		updateResult = "UPDATE rdas_dev: FAILED - " + err.Error()
+	} else if n == 0 {
+		updateResult = retryForNewDevice(deviceID, state)
 	} else {
-		log.Printf("Updated rdas_dev attributes for device %s", deviceID)
+		slog.Debug("Updated rdas_dev attributes", "deviceID", deviceID)
 		updateResult = "UPDATE rdas_dev: SUCCESS"
 	}
 
 	// Log to HTML file
-	WriteHTMLLog(msg.Topic(), string(payload), deviceID, 0, 0, 0, 0, time.Now().Format("2006-01-02 15:04:05"), "N/A", updateResult, "N/A", mainPower, gsmSignal, sampleTime, sendingRate, unBox)
+	results.write(LogEntry{
+		Topic:        msg.Topic(),
+		DeviceID:     deviceID,
+		Payload:      string(payload),
+		ReadingTime:  localNow().Format("2006-01-02 15:04:05"),
+		UnBox:        unBox,
+		MainPower:    mainPower,
+		GSMSignal:    gsmSignal,
+		SampleTime:   sampleTime,
+		SendingRate:  sendingRate,
+		InsertResult: "N/A",
+		UpdateResult: updateResult,
+		AlertResult:  "N/A",
+	})
+	return !results.failed
 }
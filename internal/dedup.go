@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+const dedupIndexName = "uniq_device_datetime"
+
+// dedupCache remembers the most recent (deviceID, ts) pairs so that frames
+// resent from the device buffer are not inserted into sensor_data twice.
+type dedupCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+var (
+	dedup          *dedupCache
+	dedupUseIndex  bool
+	duplicateCount uint64
+)
+
+func newDedupCache(size int) *dedupCache {
+	if size <= 0 {
+		size = 10000
+	}
+	return &dedupCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// seen reports whether key is already cached and records it otherwise.
+func (c *dedupCache) seen(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		return true
+	}
+	c.items[key] = c.order.PushFront(key)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(string))
+	}
+	return false
+}
+
+func (c *dedupCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func SetupDedup(config Config, db *sql.DB) {
+	if !config.Dedup.Enabled {
+		slog.Info("Duplicate detection disabled.")
+		return
+	}
+	dedup = newDedupCache(config.Dedup.CacheSize)
+	slog.Info("Duplicate detection enabled", "cacheSize", dedup.size)
+
+	if config.Dedup.UniqueIndex {
+		if err := ensureDedupIndex(db); err != nil {
+			slog.Error("Creating unique index on sensor_data failed, falling back to cache-only deduplication", "error", err)
+			return
+		}
+		dedupUseIndex = true
+		slog.Info("Using unique index on sensor_data (deviceID, date_time)", "index", dedupIndexName)
+	}
+}
+
+func ensureDedupIndex(db *sql.DB) error {
+	if sqlDriver == "postgres" {
+		_, err := db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON sensor_data (deviceID, date_time)", dedupIndexName))
+		return err
+	}
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'sensor_data' AND index_name = ?", dedupIndexName).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	slog.Info("Creating unique index on sensor_data", "index", dedupIndexName)
+	_, err = db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON sensor_data (deviceID, date_time)", dedupIndexName))
+	return err
+}
+
+func readingKey(deviceID string, ts int64) string {
+	return fmt.Sprintf("%s|%d", deviceID, ts)
+}
+
+// isDuplicateReading checks the in-memory cache. A reading that is not a
+// duplicate is remembered, so callers must forgetReading it if storing fails.
+func isDuplicateReading(deviceID string, ts int64) bool {
+	if dedup == nil {
+		return false
+	}
+	return dedup.seen(readingKey(deviceID, ts))
+}
+
+func forgetReading(deviceID string, ts int64) {
+	if dedup == nil {
+		return
+	}
+	dedup.forget(readingKey(deviceID, ts))
+}
+
+func countDuplicate(deviceID string, ts int64, source string) {
+	total := atomic.AddUint64(&duplicateCount, 1)
+	slog.Warn("Duplicate reading dropped", "deviceID", deviceID, "ts", ts, "source", source, "duplicates", total)
+}
+
+func DuplicateCount() uint64 {
+	return atomic.LoadUint64(&duplicateCount)
+}
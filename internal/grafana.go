@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The Grafana endpoints implement the Simple JSON datasource protocol, so
+// Grafana charts sensor_data through the converter instead of reading MySQL.
+// Targets are named deviceID.sensorN; alerts are returned as annotations.
+
+const grafanaMaxPoints = 10000
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange `json:"range"`
+	MaxDataPoints int          `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // [value, unix ms]
+}
+
+type grafanaAnnotation struct {
+	Annotation json.RawMessage `json:"annotation"`
+	Time       int64           `json:"time"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+}
+
+func registerGrafana(mux *http.ServeMux) {
+	// Grafana's "Save & test" only needs a 200
+	mux.HandleFunc("GET /grafana/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("POST /grafana/search", grafanaSearch)
+	mux.HandleFunc("POST /grafana/query", grafanaQueryHandler)
+	mux.HandleFunc("POST /grafana/annotations", grafanaAnnotations)
+}
+
+// grafanaSearch lists the targets of every device in rdas_dev that contain
+// the search text.
+func grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if !decodeGrafana(w, r, &req) {
+		return
+	}
+	devices, err := store.Devices("")
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	targets := []string{}
+	for _, d := range devices {
+		for ch := 1; ch <= 4; ch++ {
+			target := fmt.Sprintf("%s.sensor%d", d.DeviceID, ch)
+			if strings.Contains(target, req.Target) {
+				targets = append(targets, target)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+// grafanaQueryHandler returns the raw readings of each target, or interval
+// averages when the range holds more readings than Grafana asked for.
+func grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var req grafanaQuery
+	if !decodeGrafana(w, r, &req) {
+		return
+	}
+	from, to := req.Range.From.In(location), req.Range.To.In(location)
+	if !from.Before(to) {
+		apiError(w, r, http.StatusBadRequest, fmt.Errorf("range.from must be before range.to"))
+		return
+	}
+	maxPoints := req.MaxDataPoints
+	if maxPoints <= 0 || maxPoints > grafanaMaxPoints {
+		maxPoints = grafanaMaxPoints
+	}
+
+	series := []grafanaSeries{}
+	// Targets of the same device share one query
+	cache := make(map[string][]grafanaPoint)
+	for _, t := range req.Targets {
+		deviceID, ch, err := parseGrafanaTarget(t.Target)
+		if err != nil {
+			apiError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		points, ok := cache[deviceID]
+		if !ok {
+			if points, err = grafanaPoints(deviceID, from, to, maxPoints); err != nil {
+				apiError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			cache[deviceID] = points
+		}
+		s := grafanaSeries{Target: t.Target, Datapoints: make([][2]float64, len(points))}
+		for i, p := range points {
+			s.Datapoints[i] = [2]float64{p.values[ch], float64(p.time.UnixMilli())}
+		}
+		series = append(series, s)
+	}
+	writeJSON(w, http.StatusOK, series)
+}
+
+type grafanaPoint struct {
+	time   time.Time
+	values [4]float64
+}
+
+func grafanaPoints(deviceID string, from, to time.Time, maxPoints int) ([]grafanaPoint, error) {
+	readings, err := store.History(deviceID, from, to, maxPoints+1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(readings) <= maxPoints {
+		points := make([]grafanaPoint, len(readings))
+		for i, r := range readings {
+			points[i] = grafanaPoint{r.Time, r.Sensors}
+		}
+		return points, nil
+	}
+	interval := (to.Sub(from)/time.Duration(maxPoints) + time.Second - 1).Truncate(time.Second)
+	rows, err := store.Aggregate(deviceID, from, to, interval)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]grafanaPoint, len(rows))
+	for i, a := range rows {
+		points[i] = grafanaPoint{a.Start, a.Avg}
+	}
+	return points, nil
+}
+
+// parseGrafanaTarget splits "T1.sensor2" into the device and channel index 1.
+func parseGrafanaTarget(target string) (string, int, error) {
+	i := strings.LastIndex(target, ".sensor")
+	if i > 0 {
+		switch target[i+len(".sensor"):] {
+		case "1", "2", "3", "4":
+			return target[:i], int(target[len(target)-1] - '1'), nil
+		}
+	}
+	return "", 0, fmt.Errorf("invalid target %q, use deviceID.sensor1 to deviceID.sensor4", target)
+}
+
+// grafanaAnnotations returns the alerts in the range. The annotation query
+// may name a device, or a project as project:NAME; empty returns all alerts.
+func grafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Range      grafanaRange    `json:"range"`
+		Annotation json.RawMessage `json:"annotation"`
+	}
+	if !decodeGrafana(w, r, &req) {
+		return
+	}
+	var annotation struct {
+		Query string `json:"query"`
+	}
+	json.Unmarshal(req.Annotation, &annotation)
+	var source, project string
+	query := strings.TrimSpace(annotation.Query)
+	if strings.HasPrefix(query, "project:") {
+		project = strings.TrimPrefix(query, "project:")
+	} else {
+		source = query
+	}
+
+	alerts, err := store.Alerts(req.Range.From.In(location), req.Range.To.In(location), source, project)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	out := make([]grafanaAnnotation, len(alerts))
+	for i, a := range alerts {
+		tags := []string{a.Source, fmt.Sprintf("priority %d", a.Priority)}
+		if a.Project != "" {
+			tags = append(tags, a.Project)
+		}
+		text := a.Description
+		if a.Note != "" {
+			text += " (" + a.Note + ")"
+		}
+		out[i] = grafanaAnnotation{
+			Annotation: req.Annotation,
+			Time:       a.EventTime.UnixMilli(),
+			Title:      a.Source,
+			Text:       text,
+			Tags:       tags,
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func decodeGrafana(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		apiError(w, r, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
@@ -1,185 +1,309 @@
 package internal
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
+	"html/template"
+	"log/slog"
 	"strings"
 	"time"
 )
 
-func WriteHTMLLog(topic, originalPayload, deviceID string, sensor1, sensor2, sensor3, sensor4 float64, timestamp, insertResult, updateResult, alertResult string, mainPower float64, gsmSignal int, sampleTime int, sendingRate int, unBox string) {
-	// Wrap raw data if longer than 100 chars
-	wrappedPayload := wrapText(originalPayload, 100)
-	// Create log directory
-	logDir := "/opt/lampp/htdocs/DAQ/LOG"
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		log.Printf("Error creating log directory: %v", err)
-		return
+// LogEntry is one processed, rejected or failed message in the per-device log.
+type LogEntry struct {
+	Time         time.Time  `json:"time"`
+	Topic        string     `json:"topic"`
+	DeviceID     string     `json:"device_id"`
+	Payload      string     `json:"payload"`
+	ReadingTime  string     `json:"reading_time"`
+	Sensors      [4]float64 `json:"sensors"`
+	UnBox        string     `json:"unbox,omitempty"`
+	MainPower    float64    `json:"main_power,omitempty"`
+	GSMSignal    int        `json:"gsm_signal,omitempty"`
+	SampleTime   int        `json:"sample_time,omitempty"`
+	SendingRate  int        `json:"sending_rate,omitempty"`
+	InsertResult string     `json:"insert_result"`
+	UpdateResult string     `json:"update_result"`
+	AlertResult  string     `json:"alert_result"`
+}
+
+// HasError reports whether any operation of the entry failed or the message
+// was refused.
+func (e LogEntry) HasError() bool {
+	for _, r := range []string{e.InsertResult, e.UpdateResult, e.AlertResult} {
+		if isErrorResult(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageLog writes the device log entries of one message and remembers
+// whether any of them failed.
+type messageLog struct {
+	failed bool
+}
+
+func (l *messageLog) write(entry LogEntry) {
+	if entry.HasError() {
+		l.failed = true
+	}
+	WriteLog(entry)
+}
+
+func isErrorResult(result string) bool {
+	for _, marker := range []string{"FAILED", "ERROR", "INVALID", "REJECTED"} {
+		if strings.Contains(result, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+type logField struct {
+	Name  string
+	Value string
+}
+
+// fields returns the processed values shown for the entry, in display order.
+func (e LogEntry) fields() []logField {
+	out := []logField{
+		{"Timestamp", e.ReadingTime},
+		{"DeviceID", e.DeviceID},
+		{"Type", "MQTT"},
+	}
+	switch {
+	case strings.Contains(e.Topic, "attributes"):
+		out = append(out,
+			logField{"MainPower", formatNumber(e.MainPower)},
+			logField{"GSMSignal", fmt.Sprint(e.GSMSignal)},
+			logField{"sample_time", fmt.Sprint(e.SampleTime)},
+			logField{"SendingRate", fmt.Sprint(e.SendingRate)},
+		)
+	case e.Sensors != [4]float64{}:
+		for i, v := range e.Sensors {
+			out = append(out, logField{fmt.Sprintf("Current_ss%d", i+1), formatNumber(v)})
+		}
+		out = append(out, logField{"SensorPowerStatus", "ON"}, logField{"GSMSignal", "0"})
+	}
+	out = append(out, logField{"UnBox", e.UnBox})
+	if e.AlertResult != "N/A" && e.AlertResult != "" {
+		out = append(out, logField{"Alert", e.AlertResult})
+	}
+	return out
+}
+
+// results returns the database operation results shown for the entry.
+func (e LogEntry) results() []string {
+	out := []string{e.InsertResult, e.UpdateResult}
+	if e.AlertResult != "N/A" && e.AlertResult != "" {
+		out = append(out, e.AlertResult)
 	}
+	return out
+}
+
+// Format numbers without unnecessary decimals
+func formatNumber(val float64) string {
+	if val == float64(int(val)) {
+		return fmt.Sprintf("%.0f", val)
+	}
+	return fmt.Sprintf("%.3f", val)
+}
 
-	// Generate filename: LOG_12_09_2025-T24000.html
-	now := time.Now()
-	dateStr := now.Format("02_01_2006") // DD_MM_YYYY
-	filename := fmt.Sprintf("LOG_%s-%s.html", dateStr, deviceID)
-	filePath := filepath.Join(logDir, filename)
+// LogSink renders log entries into a per-device, per-day file.
+type LogSink interface {
+	// Extension is the file extension of the files written by the sink.
+	Extension() string
+	// Header is written to a new file, Footer closes it. Entries are inserted
+	// before the footer so that the file is always complete.
+	Header(deviceID string, day time.Time) ([]byte, error)
+	Footer() []byte
+	Entry(entry LogEntry) ([]byte, error)
+	// ErrorLine reports whether line is the one line of an entry with an
+	// error that marks it as such.
+	ErrorLine(line []byte) bool
+}
+
+var (
+	logDir     = "/opt/lampp/htdocs/DAQ/LOG"
+	logSinks   = []LogSink{htmlSink{}}
+	logMaxSize int64
+)
 
-	// Check if file exists to determine if we need to write header
-	fileExists := true
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		fileExists = false
+func SetupDeviceLog(config Config) {
+	c := config.DeviceLog
+	if c.Dir != "" {
+		logDir = c.Dir
+	}
+	logMaxSize = int64(c.MaxFileSizeMB) << 20
+	logRetention = c.Retention
+	if c.MaxOpenFiles > 0 {
+		logFiles.maxOpen = c.MaxOpenFiles
 	}
+	if c.FlushInterval > 0 {
+		logFiles.flushInterval = c.FlushInterval
+	}
+	slog.Info("Device log directory", "dir", logDir)
 
-	// Open file for append
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		log.Printf("Error opening log file: %v", err)
+	formats := c.Formats
+	if len(formats) == 0 {
 		return
 	}
-	defer file.Close()
+	var sinks []LogSink
+	for _, format := range formats {
+		switch format {
+		case "html":
+			sinks = append(sinks, htmlSink{})
+		case "json":
+			sinks = append(sinks, jsonSink{})
+		case "text":
+			sinks = append(sinks, textSink{})
+		default:
+			slog.Warn("Unknown device_log format, ignoring it", "format", format)
+		}
+	}
+	if len(sinks) > 0 {
+		logSinks = sinks
+	}
+	slog.Info("Device log formats", "formats", strings.Join(formats, ", "))
+}
 
-	// Write HTML header if new file
-	if !fileExists {
-		header := fmt.Sprintf(`<!DOCTYPE html>
+var htmlTemplates = template.Must(template.New("log").Funcs(template.FuncMap{
+	"resultClass": func(result string) string {
+		if isErrorResult(result) {
+			return "error"
+		}
+		return "success"
+	},
+}).Parse(`{{define "header"}}<!DOCTYPE html>
 <html>
 <head>
-    <title>Device Log - %s</title>
+    <meta charset="utf-8">
+    <title>Device Log - {{.DeviceID}}</title>
     <style>
-        table { border-collapse: collapse; width: 100%%; font-family: Arial, sans-serif; }
+        table { border-collapse: collapse; width: 100%; font-family: Arial, sans-serif; }
         th, td { border: 1px solid #ddd; padding: 8px; text-align: left; vertical-align: top; }
         th { background-color: #f2f2f2; }
         tr:nth-child(even) { background-color: #f9f9f9; }
         .timestamp { font-weight: bold; color: #333; }
         .success { color: green; }
         .error { color: red; }
-        .raw-data { max-width: 40%%; word-wrap: break-word; white-space: pre-wrap; }
-        .processed-data { max-width: 30%%; }
-        .db-ops { max-width: 30%%; }
+        .raw-data { max-width: 40%; word-wrap: break-word; white-space: pre-wrap; }
+        .processed-data { max-width: 30%; }
+        .db-ops { max-width: 30%; }
     </style>
 </head>
 <body>
-    <h1>Device Log - %s</h1>
-    <h2>Date: %s</h2>
+    <h1>Device Log - {{.DeviceID}}</h1>
+    <h2>Date: {{.Date}}</h2>
     <table>
         <tr>
             <th>Timestamp</th>
             <th>Device ID</th>
             <th>MQTT Topic</th>
-            <th style="width: 40%%;">Raw Data</th>
-            <th style="width: 30%%;">Processed Data</th>
-            <th style="width: 30%%;">Database Operations</th>
+            <th style="width: 40%;">Raw Data</th>
+            <th style="width: 30%;">Processed Data</th>
+            <th style="width: 30%;">Database Operations</th>
         </tr>
-`, deviceID, deviceID, now.Format("02/01/2006"))
-		file.WriteString(header)
-		log.Printf("Created new HTML log file for device %s", deviceID)
-	}
+{{end}}{{define "row"}}        <tr{{if .Error}} data-error="1"{{end}}>
+            <td class="timestamp">{{.Time}}</td>
+            <td>{{.DeviceID}}</td>
+            <td>{{.Topic}}</td>
+            <td class="raw-data">{{range $i, $line := .Payload}}{{if $i}}<br>{{end}}{{$line}}{{end}}</td>
+            <td class="processed-data">{{range $i, $f := .Fields}}{{if $i}}<br>
+{{end}}{{$f.Name}}: {{$f.Value}}{{end}}</td>
+            <td class="db-ops">{{range $i, $r := .Results}}{{if $i}}<br>{{end}}<span class="{{resultClass $r}}">{{$r}}</span>{{end}}</td>
+        </tr>
+{{end}}`))
 
-	// Create data row
-	currentTime := now.Format("2006-01-02 15:04:05")
+const htmlFooter = "    </table>\n</body>\n</html>\n"
 
-	// Format numbers without unnecessary decimals
-	formatNumber := func(val float64) string {
-		if val == float64(int(val)) {
-			return fmt.Sprintf("%.0f", val)
-		}
-		return fmt.Sprintf("%.3f", val)
-	}
-
-	processedData := ""
-	if sensor1 == 0 && sensor2 == 0 && sensor3 == 0 && sensor4 == 0 {
-		// Only UnBox, no sensor data
-		processedData = fmt.Sprintf(`Timestamp: %s<br>
-DeviceID: %s<br>
-Type: MQTT<br>
-UnBox: %s`,
-			timestamp, deviceID, unBox)
-	} else {
-		// Full sensor data
-		processedData = fmt.Sprintf(`Timestamp: %s<br>
-DeviceID: %s<br>
-Type: MQTT<br>
-Current_ss1: %s<br>
-Current_ss2: %s<br>
-Current_ss3: %s<br>
-Current_ss4: %s<br>
-SensorPowerStatus: ON<br>
-GSMSignal: 0<br>
-UnBox: %s`,
-			timestamp, deviceID,
-			formatNumber(sensor1), formatNumber(sensor2),
-			formatNumber(sensor3), formatNumber(sensor4), unBox)
-	}
-
-	if alertResult != "N/A" {
-		processedData += fmt.Sprintf(`<br>Alert: %s`, alertResult)
-	}
-
-	if strings.Contains(topic, "attributes") {
-		// For attributes, show the attributes data
-		processedData = fmt.Sprintf(`Timestamp: %s<br>
-DeviceID: %s<br>
-Type: MQTT<br>
-MainPower: %s<br>
-GSMSignal: %d<br>
-sample_time: %d<br>
-SendingRate: %d<br>
-UnBox: %s`,
-			timestamp, deviceID,
-			formatNumber(mainPower), gsmSignal, sampleTime, sendingRate, unBox)
-		if alertResult != "N/A" {
-			processedData += fmt.Sprintf(`<br>Alert: %s`, alertResult)
-		}
-	}
+type htmlSink struct{}
 
-	// Determine CSS class based on operation results
-	insertClass := "success"
-	updateClass := "success"
-	alertClass := "success"
-	if strings.Contains(insertResult, "FAILED") {
-		insertClass = "error"
-	}
-	if strings.Contains(updateResult, "FAILED") {
-		updateClass = "error"
-	}
-	if strings.Contains(alertResult, "FAILED") {
-		alertClass = "error"
-	}
+func (htmlSink) Extension() string { return "html" }
 
-	databaseOps := fmt.Sprintf(`<span class="%s">%s</span><br><span class="%s">%s</span>`,
-		insertClass, insertResult, updateClass, updateResult)
-	if alertResult != "N/A" {
-		databaseOps += fmt.Sprintf(`<br><span class="%s">%s</span>`, alertClass, alertResult)
-	}
+func (htmlSink) Header(deviceID string, day time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	err := htmlTemplates.ExecuteTemplate(&buf, "header", struct{ DeviceID, Date string }{deviceID, day.Format("02/01/2006")})
+	return buf.Bytes(), err
+}
 
-	row := fmt.Sprintf(`        <tr>
-            <td class="timestamp">%s</td>
-            <td>%s</td>
-            <td>%s</td>
-            <td class="raw-data">%s</td>
-            <td class="processed-data">%s</td>
-            <td class="db-ops">%s</td>
-        </tr>
-`, currentTime, deviceID, topic, wrappedPayload, processedData, databaseOps)
+func (htmlSink) Footer() []byte { return []byte(htmlFooter) }
+func (htmlSink) ErrorLine(line []byte) bool {
+	return bytes.Contains(line, []byte(`data-error="1"`))
+}
+
+func (htmlSink) Entry(e LogEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	err := htmlTemplates.ExecuteTemplate(&buf, "row", struct {
+		Time, DeviceID, Topic string
+		Error                 bool
+		Payload               []string
+		Fields                []logField
+		Results               []string
+	}{
+		Time:     e.Time.Format("2006-01-02 15:04:05"),
+		DeviceID: e.DeviceID,
+		Topic:    e.Topic,
+		Error:    e.HasError(),
+		// Wrap raw data if longer than 100 chars
+		Payload: wrapText(e.Payload, 100),
+		Fields:  e.fields(),
+		Results: e.results(),
+	})
+	return buf.Bytes(), err
+}
+
+type jsonSink struct{}
+
+func (jsonSink) Extension() string                        { return "jsonl" }
+func (jsonSink) Header(string, time.Time) ([]byte, error) { return nil, nil }
+func (jsonSink) Footer() []byte                           { return nil }
+func (jsonSink) ErrorLine(line []byte) bool               { return bytes.Contains(line, []byte(`"error":true`)) }
+
+func (jsonSink) Entry(e LogEntry) ([]byte, error) {
+	line, err := json.Marshal(struct {
+		LogEntry
+		Error bool `json:"error"`
+	}{e, e.HasError()})
+	return append(line, '\n'), err
+}
 
-	file.WriteString(row)
-	log.Printf("Written HTML log for device %s", deviceID)
+type textSink struct{}
+
+func (textSink) Extension() string                        { return "log" }
+func (textSink) Header(string, time.Time) ([]byte, error) { return nil, nil }
+func (textSink) Footer() []byte                           { return nil }
+
+// textLevelColumn is where the level starts, after the fixed width time.
+// Fields and results are not escaped and may contain "ERROR" themselves, so
+// only this column is checked.
+const textLevelColumn = len("2006-01-02 15:04:05 ")
+
+func (textSink) ErrorLine(line []byte) bool {
+	return bytes.HasPrefix(line[min(textLevelColumn, len(line)):], []byte("ERROR "))
 }
 
-func wrapText(text string, maxLen int) string {
-	if len(text) <= maxLen {
-		return text
+func (textSink) Entry(e LogEntry) ([]byte, error) {
+	var fields []string
+	for _, f := range e.fields() {
+		fields = append(fields, f.Name+"="+f.Value)
 	}
-	var result strings.Builder
-	for i := 0; i < len(text); i += maxLen {
-		end := i + maxLen
-		if end > len(text) {
-			end = len(text)
-		}
-		result.WriteString(text[i:end])
-		if end < len(text) {
-			result.WriteString("<br>")
-		}
+	level := "OK"
+	if e.HasError() {
+		level = "ERROR"
+	}
+	return []byte(fmt.Sprintf("%s %-5s %s %s | %s | %s | payload=%q\n",
+		e.Time.Format("2006-01-02 15:04:05"), level, e.DeviceID, e.Topic,
+		strings.Join(fields, " "), strings.Join(e.results(), "; "), e.Payload)), nil
+}
+
+func wrapText(text string, maxLen int) []string {
+	var lines []string
+	for len(text) > maxLen {
+		lines = append(lines, text[:maxLen])
+		text = text[maxLen:]
 	}
-	return result.String()
+	return append(lines, text)
 }
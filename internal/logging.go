@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SetupLogging installs the application logger. Per-message details and the
+// SQL of every statement are logged at debug level; lifecycle events at info;
+// dropped messages and failed operations at warn and error.
+func SetupLogging(config Config) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Logging.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactSecrets(configSecrets(config))}
+
+	var handler slog.Handler
+	if strings.EqualFold(config.Logging.Format, "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	slog.Info("Logging configured", "level", level.String(), "format", config.Logging.Format)
+}
+
+// redactedSecret replaces passwords in logs, as in net/url's URL.Redacted. It
+// needs no escaping in a DSN.
+const redactedSecret = "xxxxx"
+
+// configSecrets returns the passwords of config, with the escaped forms they
+// take in DSNs and URLs.
+func configSecrets(config Config) []string {
+	var secrets []string
+	for _, secret := range []string{config.MQTT.Pass, config.SQL.Pass, config.HTTP.Token} {
+		if secret == "" {
+			continue
+		}
+		secrets = append(secrets, secret)
+		if escaped := url.QueryEscape(secret); escaped != secret {
+			secrets = append(secrets, escaped)
+		}
+		if escaped := url.PathEscape(secret); escaped != secret {
+			secrets = append(secrets, escaped)
+		}
+	}
+	return secrets
+}
+
+// redactSecrets replaces the secrets wherever they appear in a log record,
+// including the message and the text of errors, such as a driver error that
+// quotes the DSN.
+func redactSecrets(secrets []string) func([]string, slog.Attr) slog.Attr {
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if len(secrets) == 0 {
+			return a
+		}
+		var text string
+		switch a.Value.Kind() {
+		case slog.KindString:
+			text = a.Value.String()
+		case slog.KindAny:
+			text = fmt.Sprint(a.Value.Any())
+		default:
+			return a
+		}
+		redacted := text
+		for _, secret := range secrets {
+			redacted = strings.ReplaceAll(redacted, secret, redactedSecret)
+		}
+		if redacted != text {
+			a.Value = slog.StringValue(redacted)
+		}
+		return a
+	}
+}
+
+// sqlExecer is a *sql.DB or a *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// execSQL runs a statement, logging it at debug level and a failure at error
+// level, both with the operation name and duration. ? placeholders work on
+// every driver.
+func execSQL(db sqlExecer, operation, deviceID, query string, args ...interface{}) (sql.Result, error) {
+	query = rebind(query)
+	start := time.Now()
+	res, err := db.Exec(query, args...)
+	duration := time.Since(start)
+	metricDBDuration.observe(duration.Seconds(), operation)
+	if err != nil {
+		metricDBErrors.inc(operation)
+		slog.Error("SQL statement failed", "operation", operation, "deviceID", deviceID, "duration", duration, "error", err, "sql", query)
+		return res, err
+	}
+	slog.Debug("SQL statement executed", "operation", operation, "deviceID", deviceID, "duration", duration, "sql", query)
+	return res, nil
+}
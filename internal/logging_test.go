@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	var config Config
+	config.MQTT.Pass = "mqtt-pa55"
+	config.SQL.Pass = "p@ss/w rd"
+	config.HTTP.Token = "t0ken"
+	tests := []struct {
+		name  string
+		log   func(*slog.Logger)
+		leaks []string
+		want  string
+	}{
+		{"message", func(l *slog.Logger) { l.Info("connecting with mqtt-pa55") }, []string{"mqtt-pa55"}, "connecting with xxxxx"},
+		{"string attribute", func(l *slog.Logger) { l.Info("connect", "token", "t0ken") }, []string{"t0ken"}, "token=xxxxx"},
+		{"error attribute", func(l *slog.Logger) {
+			l.Error("open failed", "error", errors.New("dial root:p@ss/w rd@tcp(db:3306)"))
+		}, []string{"p@ss/w rd"}, "root:xxxxx@tcp"},
+		{"query escaped", func(l *slog.Logger) { l.Info("dsn", "dsn", "postgres://root:p%40ss%2Fw+rd@db/daq") }, []string{"p%40ss%2Fw+rd"}, "root:xxxxx@db"},
+		{"path escaped", func(l *slog.Logger) { l.Info("dsn", "dsn", "postgres://root:p@ss%2Fw%20rd@db/daq") }, []string{"p@ss%2Fw%20rd"}, "root:xxxxx@db"},
+		{"group", func(l *slog.Logger) { l.Info("config", slog.Group("sql", "pass", "p@ss/w rd")) }, []string{"p@ss/w rd"}, "sql.pass=xxxxx"},
+		{"other values untouched", func(l *slog.Logger) { l.Info("status", "count", 3, "host", "db") }, nil, "count=3 host=db"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		tt.log(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactSecrets(configSecrets(config))})))
+		out := buf.String()
+		for _, leak := range tt.leaks {
+			if strings.Contains(out, leak) {
+				t.Errorf("%s: %q leaks %q", tt.name, out, leak)
+			}
+		}
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("%s: %q does not contain %q", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestRedactSecretsWithoutSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactSecrets(configSecrets(Config{}))})).Info("plain", "pass", "")
+	if !strings.Contains(buf.String(), `msg=plain pass=""`) {
+		t.Errorf("output %q changed without secrets", buf.String())
+	}
+}
@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"html/template"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LogRetention struct {
+	CompressAfterDays int `yaml:"compress_after_days"`
+	DeleteAfterDays   int `yaml:"delete_after_days"`
+}
+
+var (
+	logRetention LogRetention
+
+	// LOG_12_09_2025-T24000.html, LOG_12_09_2025-T24000.2.jsonl.gz, ...
+	logFileRe = regexp.MustCompile(`^LOG_(\d{2}_\d{2}_\d{4})-(.+?)(?:\.(\d+))?\.(html|jsonl|log)(\.gz)?$`)
+
+	errorCountMu sync.Mutex
+	errorCounts  = make(map[string]errorCount)
+)
+
+// maxLogLine is the longest line countErrors reads, well above an entry with
+// a large payload.
+const maxLogLine = 16 << 20
+
+type errorCount struct {
+	size    int64
+	modTime time.Time
+	errors  int
+}
+
+type logFile struct {
+	Name       string
+	DeviceID   string
+	Day        time.Time
+	Part       int
+	Ext        string
+	Compressed bool
+	Size       int64
+	ModTime    time.Time
+}
+
+// StartDeviceLogMaintenance applies the retention policy once a day and keeps
+// index.html in the log directory up to date.
+func StartDeviceLogMaintenance() {
+	go func() {
+		lastRetention := ""
+		for {
+			if today := localNow().Format("2006-01-02"); today != lastRetention {
+				applyLogRetention()
+				lastRetention = today
+			}
+			if err := writeLogIndex(); err != nil {
+				slog.Error("Writing log index failed", "error", err)
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
+
+func listLogFiles() ([]logFile, error) {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []logFile
+	for _, e := range entries {
+		m := logFileRe.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		day, err := time.ParseInLocation("02_01_2006", m[1], location)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		part := 1
+		if m[3] != "" {
+			part, _ = strconv.Atoi(m[3])
+		}
+		files = append(files, logFile{
+			Name:       e.Name(),
+			DeviceID:   m[2],
+			Day:        day,
+			Part:       part,
+			Ext:        m[4],
+			Compressed: m[5] != "",
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+		})
+	}
+	return files, nil
+}
+
+func applyLogRetention() {
+	if logRetention.CompressAfterDays <= 0 && logRetention.DeleteAfterDays <= 0 {
+		return
+	}
+	files, err := listLogFiles()
+	if err != nil {
+		slog.Error("Listing log directory failed", "dir", logDir, "error", err)
+		return
+	}
+	now := localNow()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	deleted, compressed := 0, 0
+	for _, f := range files {
+		age := int(today.Sub(f.Day).Hours() / 24)
+		path := filepath.Join(logDir, f.Name)
+		switch {
+		case logRetention.DeleteAfterDays > 0 && age > logRetention.DeleteAfterDays:
+			if err := os.Remove(path); err != nil {
+				slog.Error("Deleting log file failed", "file", f.Name, "error", err)
+				continue
+			}
+			deleted++
+		case logRetention.CompressAfterDays > 0 && age > logRetention.CompressAfterDays && !f.Compressed:
+			if err := gzipFile(path); err != nil {
+				slog.Error("Compressing log file failed", "file", f.Name, "error", err)
+				continue
+			}
+			compressed++
+		}
+	}
+	if deleted > 0 || compressed > 0 {
+		slog.Info("Log retention applied", "deleted", deleted, "compressed", compressed)
+	}
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func sinkForExt(ext string) LogSink {
+	switch ext {
+	case "jsonl":
+		return jsonSink{}
+	case "log":
+		return textSink{}
+	}
+	return htmlSink{}
+}
+
+// pruneErrorCounts drops the cached counts of files that are no longer in
+// files, such as deleted ones and the uncompressed name of gzipped ones.
+func pruneErrorCounts(files []logFile) {
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		present[f.Name] = true
+	}
+	errorCountMu.Lock()
+	defer errorCountMu.Unlock()
+	for name := range errorCounts {
+		if !present[name] {
+			delete(errorCounts, name)
+		}
+	}
+}
+
+// countErrors returns the number of entries with an error in a log file. The
+// result is cached until the file changes.
+func countErrors(f logFile) int {
+	errorCountMu.Lock()
+	c, ok := errorCounts[f.Name]
+	errorCountMu.Unlock()
+	if ok && c.size == f.Size && c.modTime.Equal(f.ModTime) {
+		return c.errors
+	}
+
+	file, err := os.Open(filepath.Join(logDir, f.Name))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if f.Compressed {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return 0
+		}
+		defer zr.Close()
+		r = zr
+	}
+	// Error markers never span lines, so the file is counted a line at a
+	// time instead of being read into memory whole
+	sink := sinkForExt(f.Ext)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	n := 0
+	for scanner.Scan() {
+		if sink.ErrorLine(scanner.Bytes()) {
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Warn("Counting errors in log file failed", "file", f.Name, "error", err)
+		return n
+	}
+
+	errorCountMu.Lock()
+	errorCounts[f.Name] = errorCount{size: f.Size, modTime: f.ModTime, errors: n}
+	errorCountMu.Unlock()
+	return n
+}
+
+var logIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>Device Logs</title>
+    <style>
+        table { border-collapse: collapse; font-family: Arial, sans-serif; margin-bottom: 24px; }
+        th, td { border: 1px solid #ddd; padding: 6px 10px; text-align: left; }
+        th { background-color: #f2f2f2; }
+        .error { color: red; font-weight: bold; }
+    </style>
+</head>
+<body>
+    <h1>Device Logs</h1>
+    <p>Updated {{.Updated}}</p>
+{{range .Days}}    <h2>{{.Date}}</h2>
+    <table>
+        <tr><th>Device ID</th><th>Files</th><th>Errors</th><th>Size</th></tr>
+{{range .Devices}}        <tr>
+            <td>{{.DeviceID}}</td>
+            <td>{{range $i, $f := .Files}}{{if $i}}<br>{{end}}<a href="{{$f}}">{{$f}}</a>{{end}}</td>
+            <td{{if .Errors}} class="error"{{end}}>{{.Errors}}</td>
+            <td>{{.Size}}</td>
+        </tr>
+{{end}}    </table>
+{{end}}</body>
+</html>
+`))
+
+type indexDevice struct {
+	DeviceID string
+	Files    []string
+	Errors   int
+	Size     string
+	bytes    int64
+}
+
+type indexDay struct {
+	Date    string
+	day     time.Time
+	Devices []*indexDevice
+}
+
+// writeLogIndex regenerates index.html, listing the log files of every day
+// and device with the number of entries that have an error.
+func writeLogIndex() error {
+	files, err := listLogFiles()
+	if err != nil {
+		return err
+	}
+	pruneErrorCounts(files)
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].DeviceID != files[j].DeviceID {
+			return files[i].DeviceID < files[j].DeviceID
+		}
+		if files[i].Ext != files[j].Ext {
+			return files[i].Ext < files[j].Ext
+		}
+		return files[i].Part < files[j].Part
+	})
+
+	days := make(map[string]*indexDay)
+	devices := make(map[string]*indexDevice)
+	for _, f := range files {
+		dayKey := f.Day.Format("2006-01-02")
+		d, ok := days[dayKey]
+		if !ok {
+			d = &indexDay{Date: f.Day.Format("02/01/2006"), day: f.Day}
+			days[dayKey] = d
+		}
+		devKey := dayKey + "|" + f.DeviceID
+		dev, ok := devices[devKey]
+		if !ok {
+			dev = &indexDevice{DeviceID: f.DeviceID}
+			devices[devKey] = dev
+			d.Devices = append(d.Devices, dev)
+		}
+		dev.Files = append(dev.Files, f.Name)
+		dev.bytes += f.Size
+		// Every format holds the same entries, so count the errors only once
+		if f.Ext == logSinks[0].Extension() {
+			dev.Errors += countErrors(f)
+		}
+	}
+
+	var sorted []*indexDay
+	for _, d := range days {
+		for _, dev := range d.Devices {
+			dev.Size = formatSize(dev.bytes)
+		}
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].day.After(sorted[j].day) })
+
+	var buf bytes.Buffer
+	err = logIndexTemplate.Execute(&buf, struct {
+		Updated string
+		Days    []*indexDay
+	}{localNow().Format("2006-01-02 15:04:05"), sorted})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(logDir, "index.html.tmp")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(logDir, "index.html"))
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + " MB"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + " KB"
+	}
+	return strconv.FormatInt(n, 10) + " B"
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountErrors(t *testing.T) {
+	defer func(d string) { logDir = d }(logDir)
+	logDir = t.TempDir()
+	long := strings.Repeat("x", 200*1024)
+	tests := []struct {
+		name    string
+		content string
+		gzip    bool
+		want    int
+	}{
+		{"LOG_01_05_2024-T1.jsonl", `{"error":true}` + "\n" + `{"error":false}` + "\n" + `{"error":true,"payload":"a"}` + "\n", false, 2},
+		{"LOG_01_05_2024-T2.jsonl", `{"error":true,"payload":"` + long + `"}` + "\n" + `{"error":true}` + "\n", false, 2},
+		{"LOG_01_05_2024-T3.html", `<tr data-error="1"><td>a</td></tr>` + "\n" + `<tr><td>b</td></tr>` + "\n", false, 1},
+		{"LOG_01_05_2024-T4.log", "2024-05-01 10:00:00 ERROR dev1 t | a=1 | insert failed | payload=\"x\"\n2024-05-01 10:00:01 OK    dev1 t | a=1 | ok | payload=\"x\"\n", true, 1},
+		{"LOG_01_05_2024-T6.log", "2024-05-01 10:00:00 OK    dev1 t | | PARSE ERROR | payload=\"a ERROR b\"\n", false, 0},
+		{"LOG_01_05_2024-T5.jsonl", "", false, 0},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(logDir, tt.name)
+		if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.gzip {
+			if err := gzipFile(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	files, err := listLogFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, f := range files {
+		counts[strings.TrimSuffix(f.Name, ".gz")] = countErrors(f)
+	}
+	for _, tt := range tests {
+		if got := counts[tt.name]; got != tt.want {
+			t.Errorf("countErrors(%s) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPruneErrorCounts(t *testing.T) {
+	defer func(c map[string]errorCount) { errorCounts = c }(errorCounts)
+	errorCounts = map[string]errorCount{
+		"LOG_01_05_2024-T1.html":    {errors: 1},
+		"LOG_01_05_2024-T1.html.gz": {errors: 1},
+		"LOG_01_04_2024-T1.html":    {errors: 3},
+	}
+	pruneErrorCounts([]logFile{{Name: "LOG_01_05_2024-T1.html.gz"}, {Name: "LOG_02_05_2024-T1.html"}})
+	if len(errorCounts) != 1 {
+		t.Errorf("errorCounts = %v, want only LOG_01_05_2024-T1.html.gz", errorCounts)
+	}
+	if _, ok := errorCounts["LOG_01_05_2024-T1.html.gz"]; !ok {
+		t.Errorf("errorCounts = %v, want LOG_01_05_2024-T1.html.gz kept", errorCounts)
+	}
+}
+
+func TestSinkErrorLine(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		entry LogEntry
+		want  int
+	}{
+		{LogEntry{Time: ts, DeviceID: "dev1", Topic: "t", InsertResult: "INSERT FAILED"}, 1},
+		{LogEntry{Time: ts, DeviceID: "dev1", Topic: "t ERROR t", Payload: `{"error":true} data-error="1" x ERROR y`, InsertResult: "OK"}, 0},
+	}
+	for _, sink := range []LogSink{htmlSink{}, jsonSink{}, textSink{}} {
+		for _, tt := range tests {
+			out, err := sink.Entry(tt.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			for _, line := range bytes.Split(out, []byte("\n")) {
+				if sink.ErrorLine(line) {
+					n++
+				}
+			}
+			if n != tt.want {
+				t.Errorf("%s: error lines in %q = %d, want %d", sink.Extension(), out, n, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// logWriter keeps the device log files open between messages. Entries are
+// buffered per file and written, followed by the sink footer, by a periodic
+// flush. Handles of previous days are closed after midnight and the least
+// recently used ones once more than maxOpen files are open.
+type logWriter struct {
+	mu            sync.Mutex // guards files, lru and parts
+	files         map[string]*logHandle
+	lru           *list.List
+	parts         map[string]int
+	maxOpen       int
+	flushInterval time.Duration
+	start         sync.Once
+	stop          chan struct{}
+	stopped       chan struct{}
+}
+
+// logHandle is one open log file. Its mutex serializes all writes to it.
+type logHandle struct {
+	mu      sync.Mutex
+	name    string
+	day     string
+	sink    LogSink
+	file    *os.File
+	end     int64 // where the footer starts, i.e. the end of the entries
+	pending bytes.Buffer
+	elem    *list.Element
+	closed  bool
+}
+
+var logFiles = &logWriter{
+	files:         make(map[string]*logHandle),
+	lru:           list.New(),
+	parts:         make(map[string]int),
+	maxOpen:       64,
+	flushInterval: time.Second,
+	stop:          make(chan struct{}),
+	stopped:       make(chan struct{}),
+}
+
+// WriteLog appends the entry to the device's log file of every sink.
+func WriteLog(entry LogEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = localNow()
+	}
+	if entry.DeviceID == "" {
+		entry.DeviceID = "unknown"
+	}
+	logFiles.start.Do(logFiles.run)
+	stats.entryWritten(entry)
+
+	for _, sink := range logSinks {
+		row, err := sink.Entry(entry)
+		if err != nil {
+			slog.Error("Rendering log entry failed", "deviceID", entry.DeviceID, "error", err)
+			continue
+		}
+		h, err := logFiles.acquire(entry, sink)
+		if err != nil {
+			slog.Error("Opening log file failed", "deviceID", entry.DeviceID, "error", err)
+			continue
+		}
+		h.pending.Write(row)
+		if h.pending.Len() >= 64<<10 || logFiles.closing() {
+			h.flush()
+		}
+		h.mu.Unlock()
+	}
+	slog.Debug("Written device log", "deviceID", entry.DeviceID, "topic", entry.Topic)
+}
+
+// CloseDeviceLog flushes and closes every open log file. It is called on
+// shutdown; entries written afterwards open their files again and are
+// written immediately.
+func CloseDeviceLog() {
+	w := logFiles
+	if !w.closing() {
+		close(w.stop)
+	}
+	w.start.Do(func() { close(w.stopped) })
+	<-w.stopped
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, h := range w.files {
+		w.closeLocked(h)
+	}
+}
+
+func (w *logWriter) closing() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire returns the locked handle of the file the entry goes to.
+func (w *logWriter) acquire(entry LogEntry, sink LogSink) (*logHandle, error) {
+	for {
+		w.mu.Lock()
+		name := w.fileName(entry, sink)
+		h, ok := w.files[name]
+		if !ok {
+			var err error
+			h, err = openLogHandle(name, sink, entry)
+			if err != nil {
+				w.mu.Unlock()
+				return nil, err
+			}
+			h.elem = w.lru.PushFront(h)
+			w.files[name] = h
+			for w.lru.Len() > w.maxOpen {
+				w.closeLocked(w.lru.Back().Value.(*logHandle))
+			}
+		} else {
+			w.lru.MoveToFront(h.elem)
+		}
+		w.mu.Unlock()
+
+		h.mu.Lock()
+		if !h.closed {
+			return h, nil
+		}
+		// Evicted between the lookup and the lock, open it again
+		h.mu.Unlock()
+	}
+}
+
+// fileName returns the file the entry goes to. Once a file reaches the size
+// cap the day continues in a numbered part: LOG_12_09_2025-T24000.2.html.
+// Must be called with w.mu held.
+func (w *logWriter) fileName(entry LogEntry, sink LogSink) string {
+	// Generate filename: LOG_12_09_2025-T24000.html
+	base := fmt.Sprintf("LOG_%s-%s", entry.Time.Format("02_01_2006"), entry.DeviceID)
+	name := func(part int) string {
+		if part <= 1 {
+			return base + "." + sink.Extension()
+		}
+		return fmt.Sprintf("%s.%d.%s", base, part, sink.Extension())
+	}
+	if logMaxSize <= 0 {
+		return name(1)
+	}
+
+	key := name(1)
+	part, ok := w.parts[key]
+	if !ok {
+		// Resume after a restart from the last part that exists
+		part = 1
+		for {
+			if _, err := os.Stat(filepath.Join(logDir, name(part+1))); err != nil {
+				break
+			}
+			part++
+		}
+	}
+	if w.size(name(part)) >= logMaxSize {
+		part++
+		slog.Info("Log file reached size cap, continuing in next part", "file", name(part-1), "maxSizeMB", logMaxSize>>20, "next", name(part))
+	}
+	w.parts[key] = part
+	return name(part)
+}
+
+// size returns the size the file has once its pending entries are written.
+func (w *logWriter) size(name string) int64 {
+	if h, ok := w.files[name]; ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.end + int64(h.pending.Len())
+	}
+	if info, err := os.Stat(filepath.Join(logDir, name)); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+func openLogHandle(name string, sink LogSink, entry LogEntry) (*logHandle, error) {
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(logDir, name), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h := &logHandle{
+		name: name,
+		day:  entry.Time.Format("02_01_2006"),
+		sink: sink,
+		file: file,
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		header, err := sink.Header(entry.DeviceID, entry.Time)
+		if err == nil {
+			_, err = file.Write(append(header, sink.Footer()...))
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		h.end = int64(len(header))
+		slog.Info("Created new log file", "file", name)
+		return h, nil
+	}
+	h.end, err = footerOffset(file, info.Size(), sink.Footer())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// footerOffset returns where the footer of an existing file starts. Files
+// without the footer, such as those written by older versions, end there.
+func footerOffset(file *os.File, size int64, footer []byte) (int64, error) {
+	n := int64(len(footer))
+	if n == 0 || size < n {
+		return size, nil
+	}
+	tail := make([]byte, n)
+	if _, err := file.ReadAt(tail, size-n); err != nil {
+		return 0, err
+	}
+	if bytes.Equal(tail, footer) {
+		return size - n, nil
+	}
+	return size, nil
+}
+
+// flush writes the pending entries in place of the footer and closes the
+// file again with it. Must be called with h.mu held.
+func (h *logHandle) flush() {
+	if h.pending.Len() == 0 || h.closed {
+		return
+	}
+	data := append(h.pending.Bytes(), h.sink.Footer()...)
+	if _, err := h.file.WriteAt(data, h.end); err != nil {
+		slog.Error("Writing log file failed", "file", h.name, "error", err)
+		return
+	}
+	h.end += int64(h.pending.Len())
+	h.pending.Reset()
+}
+
+// closeLocked flushes and closes a handle. Must be called with w.mu held.
+func (w *logWriter) closeLocked(h *logHandle) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.flush()
+	if err := h.file.Close(); err != nil {
+		slog.Error("Closing log file failed", "file", h.name, "error", err)
+	}
+	h.closed = true
+	w.lru.Remove(h.elem)
+	delete(w.files, h.name)
+}
+
+// run starts the goroutine that flushes pending entries and closes the files
+// of previous days.
+func (w *logWriter) run() {
+	go func() {
+		defer close(w.stopped)
+		ticker := time.NewTicker(w.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+			}
+			today := localNow().Format("02_01_2006")
+			w.mu.Lock()
+			for _, h := range w.files {
+				if h.day != today {
+					w.closeLocked(h)
+					continue
+				}
+				h.mu.Lock()
+				h.flush()
+				h.mu.Unlock()
+			}
+			w.mu.Unlock()
+		}
+	}()
+}
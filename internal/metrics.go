@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small implementation of the Prometheus text format, enough for the
+// counters and histograms below without pulling in client_golang.
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64 // histograms only, cumulative counts are computed on write
+	count   uint64
+}
+
+type metricVec struct {
+	name, help, kind string
+	labelNames       []string
+	bounds           []float64 // histogram bucket upper bounds
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+var metricVecs []*metricVec
+
+func newMetric(kind, name, help string, bounds []float64, labelNames ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labelNames: labelNames, bounds: bounds, series: make(map[string]*metricSeries)}
+	if len(labelNames) == 0 {
+		m.get(nil) // reported as 0 until first used
+	}
+	metricVecs = append(metricVecs, m)
+	return m
+}
+
+func (m *metricVec) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(m.bounds))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) inc(labels ...string) {
+	m.mu.Lock()
+	m.get(labels).value++
+	m.mu.Unlock()
+}
+
+func (m *metricVec) add(v float64, labels ...string) {
+	m.mu.Lock()
+	m.get(labels).value += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) set(v float64, labels ...string) {
+	m.mu.Lock()
+	m.get(labels).value = v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) observe(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	s.value += v
+	s.count++
+	for i, b := range m.bounds {
+		if v <= b {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labelNames, s.labels, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, b := range m.bounds {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labels, formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labels, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labelNames, s.labels, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labelNames, s.labels, ""), s.count)
+	}
+}
+
+func formatLabels(names, values []string, le string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+"="+strconv.Quote(values[i]))
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricMessages = newMetric("counter", "converter_messages_received_total",
+		"MQTT messages received, by topic kind.", nil, "kind")
+	metricParseErrors = newMetric("counter", "converter_parse_errors_total",
+		"Messages whose payload could not be parsed, by topic kind.", nil, "kind")
+	metricResults = newMetric("counter", "converter_messages_total",
+		"Outcome of message checks and writes: inserted, rejected, quarantined.", nil, "result")
+	metricDuplicates = newMetric("counter", "converter_duplicates_total",
+		"Readings dropped as duplicates.", nil)
+	metricDBDuration = newMetric("histogram", "converter_db_exec_duration_seconds",
+		"Latency of database statements, by operation.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}, "operation")
+	metricDBErrors = newMetric("counter", "converter_db_exec_errors_total",
+		"Failed database statements, by operation.", nil, "operation")
+	metricAlerts = newMetric("counter", "converter_alerts_total",
+		"Alerts inserted into the alert table, by type.", nil, "type")
+	metricDevices = newMetric("gauge", "converter_devices",
+		"Devices seen since start, online if a message arrived within http.offline_after.", nil, "state")
+	metricMQTTConnected = newMetric("gauge", "converter_mqtt_connected",
+		"1 if the MQTT client is connected.", nil)
+	metricMQTTLost = newMetric("counter", "converter_mqtt_connection_lost_total",
+		"Times the MQTT connection was lost.", nil)
+	metricMQTTReconnects = newMetric("counter", "converter_mqtt_reconnects_total",
+		"Successful MQTT reconnects after a lost connection.", nil)
+	metricStartTime = newMetric("gauge", "converter_start_time_seconds",
+		"Unix time the converter started.", nil)
+)
+
+var offlineAfter = 15 * time.Minute
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	// Values that are derived from other state are refreshed on every scrape
+	metricDuplicates.set(float64(DuplicateCount()))
+	metricStartTime.set(float64(stats.started.Unix()))
+	connected := 0.0
+	if mqttConnected() {
+		connected = 1
+	}
+	metricMQTTConnected.set(connected)
+	online, offline := 0, 0
+	_, devices := stats.snapshot()
+	for _, d := range devices {
+		if time.Since(d.LastSeen) <= offlineAfter {
+			online++
+		} else {
+			offline++
+		}
+	}
+	metricDevices.set(float64(online), "online")
+	metricDevices.set(float64(offline), "offline")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricVecs {
+		m.write(w)
+	}
+}
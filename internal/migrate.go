@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The schema is created and upgraded by the SQL files in migrations/<driver>/,
+// NNNN_name.up.sql and an optional NNNN_name.down.sql, applied in order of
+// NNNN. Applied versions are recorded in schema_version. MySQL commits DDL
+// immediately, so a migration that fails halfway is not rolled back; its
+// statements are written to be safe to run again.
+
+//go:embed migrations/mysql/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const createSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INT NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at %s NOT NULL
+)`
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	// Down is empty for migrations that cannot be reverted, such as the
+	// creation of tables that existed before the converter managed them
+	Down []string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt string // empty while pending
+}
+
+func loadMigrations() ([]Migration, error) {
+	dir := path.Join("migrations", sqlDriver)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = splitStatements(string(data))
+		} else {
+			mig.Down = splitStatements(string(data))
+		}
+	}
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if len(m.Up) == 0 {
+			return nil, fmt.Errorf("migration %d_%s has no up statements", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// splitStatements splits a migration file at semicolons that end a line and
+// drops comment lines. The DSN does not allow several statements per Exec.
+func splitStatements(sql string) []string {
+	var out []string
+	var cur []string
+	for _, line := range strings.Split(sql, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		cur = append(cur, line)
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			if stmt := strings.TrimSuffix(strings.TrimSpace(strings.Join(cur, "\n")), ";"); stmt != "" {
+				out = append(out, stmt)
+			}
+			cur = nil
+		}
+	}
+	if stmt := strings.TrimSpace(strings.Join(cur, "\n")); stmt != "" {
+		out = append(out, stmt)
+	}
+	return out
+}
+
+// MigrationStatuses returns every migration with the time it was applied.
+func MigrationStatuses(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	dateTime, appliedAt := "DATETIME", "applied_at"
+	if sqlDriver == "postgres" {
+		dateTime, appliedAt = "TIMESTAMP(0)", fmt.Sprintf(pgDateTime, "applied_at")
+	}
+	if _, err := db.Exec(fmt.Sprintf(createSchemaVersion, dateTime)); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, " + appliedAt + " FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		out[i] = MigrationStatus{Migration: m, AppliedAt: applied[m.Version]}
+	}
+	return out, nil
+}
+
+// MigrateUp applies the pending migrations up to and including target, or
+// all of them when target is 0.
+func MigrateUp(db *sql.DB, target int) ([]Migration, error) {
+	statuses, err := MigrationStatuses(db)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, s := range statuses {
+		if s.AppliedAt != "" || (target > 0 && s.Version > target) {
+			continue
+		}
+		for _, stmt := range s.Up {
+			if _, err := execSQL(db, "migrate_up", "", stmt); err != nil {
+				return applied, fmt.Errorf("migration %d_%s: %w", s.Version, s.Name, err)
+			}
+		}
+		if _, err := execSQL(db, "migrate_up", "", "INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+			s.Version, s.Name, localNow().Format(sqlDateTime)); err != nil {
+			return applied, err
+		}
+		slog.Info("Applied migration", "version", s.Version, "name", s.Name)
+		applied = append(applied, s.Migration)
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first.
+func MigrateDown(db *sql.DB, steps int) ([]Migration, error) {
+	statuses, err := MigrationStatuses(db)
+	if err != nil {
+		return nil, err
+	}
+	var reverted []Migration
+	for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+		s := statuses[i]
+		if s.AppliedAt == "" {
+			continue
+		}
+		if len(s.Down) == 0 {
+			return reverted, fmt.Errorf("migration %d_%s cannot be reverted", s.Version, s.Name)
+		}
+		for _, stmt := range s.Down {
+			if _, err := execSQL(db, "migrate_down", "", stmt); err != nil {
+				return reverted, fmt.Errorf("reverting %d_%s: %w", s.Version, s.Name, err)
+			}
+		}
+		if _, err := execSQL(db, "migrate_down", "", "DELETE FROM schema_version WHERE version = ?", s.Version); err != nil {
+			return reverted, err
+		}
+		slog.Info("Reverted migration", "version", s.Version, "name", s.Name)
+		reverted = append(reverted, s.Migration)
+	}
+	return reverted, nil
+}
+
+// requiredColumns lists the columns the converter reads or writes, for the
+// features enabled in config.
+func requiredColumns(config Config) map[string][]string {
+	required := map[string][]string{
+		"sensor_data": {"Idx", "deviceID", "status", "sensor1", "sensor2", "sensor3", "sensor4", "sensor5", "sensor6", "sensor7", "sensor8",
+			"SensorPowerStatus", "GSMSignal", "Current_timestamp", "date_time", "UnBox"},
+		"rdas_dev": {"userID", "devID", "Name", "Name1", "Project", "Type", "status", "LatestData",
+			"Current_ss1", "Current_ss2", "Current_ss3", "Current_ss4", "UnBox", "MainPower", "GSMSignal", "sample_time", "SendingRate"},
+		"alert":           {"EventTime", "InsertTime", "Source", "Priority", "Description", "AlertType", "Project", "Type", "Status", "Note"},
+		"mqtt_quarantine": {"id", "topic", "device_id", "payload", "reason", "received_at", "status", "reprocessed_at"},
+	}
+	if config.Rollup.Enabled {
+		for _, table := range rollupTables {
+			required[table] = []string{"deviceID", "bucket", "count", "count1", "sum1", "min1", "max1", "last_time", "last1"}
+		}
+		required["sensor_rollup_coverage"] = []string{"deviceID", "covered_from", "covered_to"}
+	}
+	if config.Totalizer.Enabled {
+		required["rdas_dev"] = append(required["rdas_dev"], "Totalizer1", "Totalizer2", "DailyLatched", "MonthlyLatched", "MonthlyTotal")
+		required["totalizer_state"] = []string{"devID", "last_time", "day_start", "month_start"}
+		required["totalizer_latched"] = []string{"devID", "period", "period_start", "total1", "total2"}
+	}
+	if config.Archive.Enabled {
+		required["sensor_data"] = archiveColumns
+	}
+	return required
+}
+
+// CheckSchema returns an error naming every required table and column that
+// is missing, and warns about pending migrations.
+func CheckSchema(config Config, db *sql.DB) error {
+	schema := "DATABASE()"
+	if sqlDriver == "postgres" {
+		// No migration creates their tables, so do not suggest one
+		if features := mysqlOnlyFeatures(config); len(features) > 0 {
+			return fmt.Errorf("%s not supported with sql.driver postgres; disable them in config.yaml", strings.Join(features, ", "))
+		}
+		schema = "current_schema()"
+	}
+	rows, err := db.Query("SELECT TABLE_NAME, COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = " + schema)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		if columns[table] == nil {
+			columns[table] = make(map[string]bool)
+		}
+		// Column names are case-insensitive in MySQL and lower case in the
+		// PostgreSQL schema
+		columns[table][strings.ToLower(column)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for table, cols := range requiredColumns(config) {
+		have, ok := columns[table]
+		if !ok {
+			missing = append(missing, "table "+table)
+			continue
+		}
+		for _, col := range cols {
+			if !have[strings.ToLower(col)] {
+				missing = append(missing, table+"."+col)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("database schema is missing %s; run `main migrate up`, and add columns missing from tables created before the converter managed the schema by hand (see database_schema.md)",
+			strings.Join(missing, ", "))
+	}
+
+	statuses, err := MigrationStatuses(db)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == "" {
+			slog.Warn("Database migration pending, run `main migrate up`", "version", s.Version, "name", s.Name)
+		}
+	}
+	if sqlDriver == "postgres" && config.SQL.Timescale {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM timescaledb_information.hypertables WHERE hypertable_name = 'sensor_data'").Scan(&count)
+		if err != nil || count == 0 {
+			slog.Warn("sensor_data is not a TimescaleDB hypertable, run `main migrate up`", "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+var idempotentRe = regexp.MustCompile(`^(CREATE (TABLE|INDEX) IF NOT EXISTS|DROP (TABLE|INDEX) IF EXISTS) `)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"only comments", "-- nothing\n  -- to do\n", nil},
+		{"one statement", "CREATE TABLE a (id INT);\n", []string{"CREATE TABLE a (id INT)"}},
+		{"without final semicolon", "DROP TABLE a", []string{"DROP TABLE a"}},
+		{"several lines", "CREATE TABLE a (\n  id INT,\n  name VARCHAR(50)\n);\n", []string{"CREATE TABLE a (\n  id INT,\n  name VARCHAR(50)\n)"}},
+		{"several statements", "-- 0001\nCREATE TABLE a (id INT);\n\nCREATE INDEX i ON a (id);\nDROP TABLE b;", []string{"CREATE TABLE a (id INT)", "CREATE INDEX i ON a (id)", "DROP TABLE b"}},
+		{"comment inside statement", "ALTER TABLE a\n  -- keep the old column for now\n  ADD COLUMN b INT;\n", []string{"ALTER TABLE a\n  ADD COLUMN b INT"}},
+		{"semicolon inside line", "INSERT INTO a VALUES ('x;y');\n", []string{"INSERT INTO a VALUES ('x;y')"}},
+		{"trailing spaces and CRLF", "DROP TABLE a;  \r\nDROP TABLE b;\r\n", []string{"DROP TABLE a", "DROP TABLE b"}},
+		{"empty statements", ";\n;\nDROP TABLE a;\n", []string{"DROP TABLE a"}},
+	}
+	for _, tt := range tests {
+		if got := splitStatements(tt.sql); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%s: splitStatements = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	defer func(d string) { sqlDriver = d }(sqlDriver)
+	for _, driver := range []string{"mysql", "postgres"} {
+		sqlDriver = driver
+		migrations, err := loadMigrations()
+		if err != nil {
+			t.Errorf("%s: %v", driver, err)
+			continue
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%s: migration %d_%s, want version %d", driver, m.Version, m.Name, i+1)
+			}
+			// A migration that failed halfway is run again from the start
+			for _, stmt := range append(m.Up, m.Down...) {
+				if !idempotentRe.MatchString(stmt) {
+					t.Errorf("%s: migration %d_%s: %.40q... cannot be run twice", driver, m.Version, m.Name, stmt)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+-- Base tables as described in database_schema.md. Existing installations
+-- already have them and are left unchanged.
+
+CREATE TABLE IF NOT EXISTS `rdas_dev` (
+	`userID` int(4) NOT NULL,
+	`devID` varchar(16) NOT NULL,
+	`SerialNumber` varchar(4) NOT NULL DEFAULT '0000',
+	`Name` varchar(128) NOT NULL,
+	`Name1` varchar(32) NOT NULL,
+	`single_dual` varchar(2) NOT NULL DEFAULT '1',
+	`Tank` int(4) NULL,
+	`SubTank` int(4) NULL,
+	`SubTank1` int(4) NULL,
+	`Location` varchar(100) NOT NULL DEFAULT '468A, Nguyễn Văn Công, Gò Vấp, TP HCM',
+	`Description` varchar(16) NOT NULL DEFAULT 'Unknown',
+	`Type` varchar(11) NOT NULL DEFAULT 'G103WM',
+	`Project` varchar(50) NOT NULL DEFAULT 'HCLOUD',
+	`status` datetime NULL,
+	`LatestData` datetime NULL,
+	`Current_ss1` varchar(12) NULL,
+	`Current_ss2` varchar(12) NULL,
+	`Current_ss3` varchar(12) NULL,
+	`Current_ss4` varchar(12) NULL,
+	`Current_ss5` varchar(12) NULL,
+	`Current_ss6` varchar(12) NULL,
+	`Current_ss7` varchar(12) NULL,
+	`Current_ss8` varchar(12) NULL,
+	`Totalizer1` double NOT NULL DEFAULT '0',
+	`Totalizer2` double NOT NULL DEFAULT '0',
+	`alarm_ss1_H` varchar(8) NOT NULL DEFAULT '16000',
+	`alarm_ss2_H` varchar(8) NOT NULL DEFAULT '16000',
+	`alarm_ss3_H` varchar(8) NOT NULL DEFAULT '16000',
+	`alarm_ss4_H` varchar(8) NOT NULL DEFAULT '16000',
+	`alarm_ss5_H` varchar(8) NOT NULL DEFAULT '16000',
+	`alarm_ss6_H` varchar(8) NOT NULL DEFAULT '16000',
+	`alarm_ss1_L` varchar(8) NOT NULL DEFAULT '4000',
+	`alarm_ss2_L` varchar(8) NOT NULL DEFAULT '4000',
+	`alarm_ss3_L` varchar(8) NOT NULL DEFAULT '4000',
+	`alarm_ss4_L` varchar(8) NOT NULL DEFAULT '4000',
+	`alarm_ss5_L` varchar(8) NOT NULL DEFAULT '4000',
+	`alarm_ss6_L` varchar(8) NOT NULL DEFAULT '4000',
+	`Lat` varchar(20) NOT NULL DEFAULT '106.68929859995',
+	`Lon` varchar(20) NOT NULL DEFAULT '10.798705000731',
+	`Connection` varchar(16) NOT NULL DEFAULT 'DOWN',
+	`Warning` varchar(256) NOT NULL DEFAULT 'Non',
+	`RstCnt` int(9) NOT NULL DEFAULT '0',
+	`SendFailed` int(9) NOT NULL DEFAULT '0',
+	`TotalFrm` int(9) NOT NULL DEFAULT '0',
+	`GSMRst` int(9) NOT NULL DEFAULT '0',
+	`FWRev` varchar(8) NOT NULL DEFAULT 'Unknown',
+	`QoS` int(1) NOT NULL DEFAULT '0',
+	`4mA_ss1` varchar(8) NOT NULL DEFAULT '4000',
+	`20mA_ss1` varchar(8) NOT NULL DEFAULT '20000',
+	`4mA_ss2` varchar(8) NOT NULL DEFAULT '4000',
+	`20mA_ss2` varchar(8) NOT NULL DEFAULT '20000',
+	`4mA_ss3` varchar(8) NOT NULL DEFAULT '4000',
+	`20mA_ss3` varchar(8) NOT NULL DEFAULT '20000',
+	`4mA_ss4` varchar(8) NOT NULL DEFAULT '4000',
+	`20mA_ss4` varchar(8) NOT NULL DEFAULT '20000',
+	`4mA_ss5` varchar(8) NOT NULL DEFAULT '4000',
+	`20mA_ss5` varchar(8) NOT NULL DEFAULT '20000',
+	`4mA_ss6` varchar(8) NOT NULL DEFAULT '4000',
+	`20mA_ss6` varchar(8) NOT NULL DEFAULT '20000',
+	`4mA_ss7` varchar(8) NOT NULL DEFAULT '4000',
+	`StartLogging` datetime NULL,
+	`EnableLogging` varchar(8) NOT NULL DEFAULT 'DISABLE',
+	`EnableLogging2` varchar(8) NULL DEFAULT 'DISABLE',
+	`4mA_ss8` varchar(8) NOT NULL DEFAULT '4000',
+	`CMDCODE1` varchar(128) NULL DEFAULT 'NOCMD',
+	`Reserve` varchar(16) NULL,
+	`formula1` varchar(1024) NULL,
+	`formula2` varchar(1024) NULL,
+	`klr` text NULL,
+	`mmO2` text NULL,
+	`Nm3` text NULL,
+	`khoiluong` text NULL,
+	`muclong` text NULL,
+	`klr_2` text NULL,
+	`mmO2_2` text NULL,
+	`Nm3_2` text NULL,
+	`khoiluong_2` text NULL,
+	`muclong_2` text NULL,
+	`sample_time` int(4) NOT NULL DEFAULT '1',
+	`SendingRate` int(2) NOT NULL DEFAULT '1',
+	`LastReport` datetime NULL,
+	`AI1_name` varchar(16) NULL DEFAULT 'Sensor1',
+	`AI2_name` varchar(16) NOT NULL DEFAULT 'Sensor2',
+	`AI3_name` char(16) NOT NULL DEFAULT 'Sensor3',
+	`AI4_name` char(16) NOT NULL DEFAULT 'Sensor4',
+	`AI5_name` char(16) NOT NULL DEFAULT 'Sensor5',
+	`AI6_name` char(16) NOT NULL DEFAULT 'Sensor6',
+	`AI7_name` varchar(24) NULL,
+	`AI8_name` varchar(24) NULL,
+	`AI1_Unit` varchar(8) NULL,
+	`AI2_Unit` varchar(8) NULL,
+	`AI3_Unit` varchar(8) NULL,
+	`AI4_Unit` varchar(8) NULL,
+	`AI5_Unit` varchar(8) NULL,
+	`AI6_Unit` varchar(8) NULL,
+	`AI7_Unit` varchar(8) NULL,
+	`AI8_Unit` varchar(8) NULL,
+	`TempInside` float NOT NULL DEFAULT '0',
+	`TempOutside` float NOT NULL DEFAULT '0',
+	`MainPower` float NOT NULL DEFAULT '0',
+	`Battery` float NOT NULL DEFAULT '0',
+	`GSMSignal` int(4) NOT NULL DEFAULT '99',
+	`CID_LAC` varchar(50) NOT NULL DEFAULT '0/0',
+	`MNC` varchar(50) NOT NULL DEFAULT 'UNKNOWN',
+	`DeviceEventCode` varchar(4) NOT NULL DEFAULT 'NEC',
+	`AlarmEnable` varchar(10) NOT NULL DEFAULT 'ENABLE',
+	`AlarmEnable2` varchar(10) NULL DEFAULT 'DISABLE',
+	`DailyLatched` varchar(16) NOT NULL DEFAULT 'D_M_000',
+	`MonthlyLatched` varchar(16) NOT NULL DEFAULT 'D_M_000',
+	`MonthlyTotal` bigint(20) NULL,
+	`AlertEmailList2` varchar(256) NULL,
+	`AlertEmailList` varchar(256) NULL,
+	`Sent_flag` varchar(16) NULL DEFAULT '0',
+	`Sent_flag2` varchar(16) NULL DEFAULT '0',
+	`OnlineStatus` varchar(3) NOT NULL DEFAULT 'ONL',
+	`BatteryStatus` varchar(3) NOT NULL DEFAULT 'OK',
+	`HWRev` varchar(8) NULL,
+	`NSX` date NULL,
+	`DataServer` varchar(32) NULL,
+	`BatteryUsage` float NULL,
+	`BatteryUsageDate` date NULL,
+	`BatteryInstallDate` date NULL,
+	`alarm_muclong_L` float NULL DEFAULT '-1',
+	`alarm_muclong_H` float NULL DEFAULT '1000000000',
+	`alarm_muclong_L2` float NULL DEFAULT '-1',
+	`alarm_muclong_H2` float NULL DEFAULT '1000000000',
+	`UnBox` varchar(1) NULL,
+	`offline_count` int(11) NULL DEFAULT '0',
+	`total_downtime_minutes` int(11) NULL DEFAULT '0',
+	`last_offline_start` datetime NULL,
+	`last_offline_end` datetime NULL,
+	`uptime_percentage` decimal(5,2) NULL DEFAULT '100.00',
+	`last_stats_update` datetime NULL,
+	KEY `devID` (`devID`),
+	KEY `Project` (`Project`)
+) DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `sensor_data` (
+	`Idx` bigint(64) NOT NULL AUTO_INCREMENT,
+	`deviceID` varchar(6) NOT NULL,
+	`HWSerial` varchar(8) NULL,
+	`status` varchar(48) NOT NULL,
+	`sensor1` double NULL,
+	`sensor2` double NULL,
+	`sensor3` double NULL,
+	`sensor4` double NULL,
+	`sensor5` varchar(12) NOT NULL,
+	`sensor6` varchar(12) NOT NULL,
+	`sensor7` varchar(12) NOT NULL,
+	`sensor8` varchar(12) NOT NULL,
+	`TempInside` varchar(4) NULL DEFAULT '',
+	`TempOutside` varchar(4) NULL DEFAULT '0',
+	`MainPower` float NULL DEFAULT '0',
+	`Battery` float NULL DEFAULT '0',
+	`SensorPowerStatus` varchar(4) NOT NULL DEFAULT 'OF',
+	`GSMSignal` int(4) NOT NULL DEFAULT '99',
+	`Current_timestamp` datetime NOT NULL,
+	`date_time` datetime NOT NULL,
+	`UnBox` varchar(2) NOT NULL,
+	`Alert` varchar(32) NULL,
+	PRIMARY KEY (`Idx`),
+	KEY `deviceID` (`deviceID`)
+) DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,19 @@
+-- alert is shared with the web application; the columns are the ones the
+-- converter writes. Existing installations are left unchanged.
+
+CREATE TABLE IF NOT EXISTS `alert` (
+	`id` bigint NOT NULL AUTO_INCREMENT,
+	`EventTime` datetime NOT NULL,
+	`InsertTime` datetime NOT NULL,
+	`Source` varchar(16) NOT NULL,
+	`Priority` int(4) NOT NULL DEFAULT '1',
+	`Description` varchar(256) NOT NULL DEFAULT '',
+	`AlertType` varchar(16) NOT NULL DEFAULT 'Device',
+	`Project` varchar(50) NOT NULL DEFAULT '',
+	`Type` varchar(16) NOT NULL DEFAULT 'Alert',
+	`Status` varchar(4) NOT NULL DEFAULT 'V',
+	`Note` varchar(256) NULL,
+	PRIMARY KEY (`id`),
+	KEY `EventTime` (`EventTime`),
+	KEY `Source` (`Source`)
+) DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS mqtt_quarantine (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	topic VARCHAR(255) NOT NULL,
+	device_id VARCHAR(64) NOT NULL DEFAULT '',
+	payload MEDIUMBLOB NOT NULL,
+	reason VARCHAR(255) NOT NULL,
+	received_at DATETIME NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'new',
+	reprocessed_at DATETIME NULL,
+	KEY idx_received_at (received_at),
+	KEY idx_device_id (device_id)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS sensor_rollup_coverage;
+DROP TABLE IF EXISTS sensor_rollup_day;
+DROP TABLE IF EXISTS sensor_rollup_hour;
@@ -0,0 +1,36 @@
+-- countN is the number of non-NULL values of sensorN, which averages divide
+-- by like AVG does on sensor_data; min and max are NULL for a bucket without
+-- any value
+CREATE TABLE IF NOT EXISTS sensor_rollup_hour (
+	deviceID VARCHAR(16) NOT NULL,
+	bucket DATETIME NOT NULL,
+	count BIGINT NOT NULL,
+	count1 BIGINT NOT NULL, count2 BIGINT NOT NULL, count3 BIGINT NOT NULL, count4 BIGINT NOT NULL,
+	sum1 DOUBLE NOT NULL, sum2 DOUBLE NOT NULL, sum3 DOUBLE NOT NULL, sum4 DOUBLE NOT NULL,
+	min1 DOUBLE NULL, min2 DOUBLE NULL, min3 DOUBLE NULL, min4 DOUBLE NULL,
+	max1 DOUBLE NULL, max2 DOUBLE NULL, max3 DOUBLE NULL, max4 DOUBLE NULL,
+	last_time DATETIME NOT NULL,
+	last1 DOUBLE NOT NULL, last2 DOUBLE NOT NULL, last3 DOUBLE NOT NULL, last4 DOUBLE NOT NULL,
+	PRIMARY KEY (deviceID, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS sensor_rollup_day (
+	deviceID VARCHAR(16) NOT NULL,
+	bucket DATETIME NOT NULL,
+	count BIGINT NOT NULL,
+	count1 BIGINT NOT NULL, count2 BIGINT NOT NULL, count3 BIGINT NOT NULL, count4 BIGINT NOT NULL,
+	sum1 DOUBLE NOT NULL, sum2 DOUBLE NOT NULL, sum3 DOUBLE NOT NULL, sum4 DOUBLE NOT NULL,
+	min1 DOUBLE NULL, min2 DOUBLE NULL, min3 DOUBLE NULL, min4 DOUBLE NULL,
+	max1 DOUBLE NULL, max2 DOUBLE NULL, max3 DOUBLE NULL, max4 DOUBLE NULL,
+	last_time DATETIME NOT NULL,
+	last1 DOUBLE NOT NULL, last2 DOUBLE NOT NULL, last3 DOUBLE NOT NULL, last4 DOUBLE NOT NULL,
+	PRIMARY KEY (deviceID, bucket)
+);
+
+-- The range of each device ('' for all devices) whose rollups were rebuilt
+-- and kept up to date since; aggregate queries read sensor_data outside it
+CREATE TABLE IF NOT EXISTS sensor_rollup_coverage (
+	deviceID VARCHAR(16) NOT NULL PRIMARY KEY,
+	covered_from DATETIME NOT NULL,
+	covered_to DATETIME NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS totalizer_latched;
+DROP TABLE IF EXISTS totalizer_state;
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS totalizer_state (
+	devID VARCHAR(16) NOT NULL PRIMARY KEY,
+	last_time DATETIME NULL,
+	last_value1 DOUBLE NOT NULL DEFAULT 0,
+	last_value2 DOUBLE NOT NULL DEFAULT 0,
+	totalizer1 DOUBLE NOT NULL DEFAULT 0,
+	totalizer2 DOUBLE NOT NULL DEFAULT 0,
+	day_start DATETIME NOT NULL,
+	day_total1 DOUBLE NOT NULL DEFAULT 0,
+	day_total2 DOUBLE NOT NULL DEFAULT 0,
+	month_start DATETIME NOT NULL,
+	month_total1 DOUBLE NOT NULL DEFAULT 0,
+	month_total2 DOUBLE NOT NULL DEFAULT 0,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS totalizer_latched (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	devID VARCHAR(16) NOT NULL,
+	period VARCHAR(8) NOT NULL,
+	period_start DATETIME NOT NULL,
+	period_end DATETIME NOT NULL,
+	total1 DOUBLE NOT NULL,
+	total2 DOUBLE NOT NULL,
+	totalizer1 DOUBLE NOT NULL,
+	totalizer2 DOUBLE NOT NULL,
+	latched_at DATETIME NOT NULL,
+	UNIQUE KEY uq_period (devID, period, period_start),
+	KEY idx_period_start (period_start)
+);
@@ -0,0 +1,172 @@
+-- Base tables as described in database_schema.md, in PostgreSQL types.
+-- Names are unquoted and so lower case, except those that start with a digit
+-- or are reserved words.
+
+CREATE TABLE IF NOT EXISTS rdas_dev (
+	userID INTEGER NOT NULL,
+	devID VARCHAR(16) NOT NULL,
+	SerialNumber VARCHAR(4) NOT NULL DEFAULT '0000',
+	Name VARCHAR(128) NOT NULL,
+	Name1 VARCHAR(32) NOT NULL,
+	single_dual VARCHAR(2) NOT NULL DEFAULT '1',
+	Tank INTEGER,
+	SubTank INTEGER,
+	SubTank1 INTEGER,
+	Location VARCHAR(100) NOT NULL DEFAULT '468A, Nguyễn Văn Công, Gò Vấp, TP HCM',
+	Description VARCHAR(16) NOT NULL DEFAULT 'Unknown',
+	Type VARCHAR(11) NOT NULL DEFAULT 'G103WM',
+	Project VARCHAR(50) NOT NULL DEFAULT 'HCLOUD',
+	status TIMESTAMP(0),
+	LatestData TIMESTAMP(0),
+	Current_ss1 VARCHAR(12),
+	Current_ss2 VARCHAR(12),
+	Current_ss3 VARCHAR(12),
+	Current_ss4 VARCHAR(12),
+	Current_ss5 VARCHAR(12),
+	Current_ss6 VARCHAR(12),
+	Current_ss7 VARCHAR(12),
+	Current_ss8 VARCHAR(12),
+	Totalizer1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+	Totalizer2 DOUBLE PRECISION NOT NULL DEFAULT 0,
+	alarm_ss1_H VARCHAR(8) NOT NULL DEFAULT '16000',
+	alarm_ss2_H VARCHAR(8) NOT NULL DEFAULT '16000',
+	alarm_ss3_H VARCHAR(8) NOT NULL DEFAULT '16000',
+	alarm_ss4_H VARCHAR(8) NOT NULL DEFAULT '16000',
+	alarm_ss5_H VARCHAR(8) NOT NULL DEFAULT '16000',
+	alarm_ss6_H VARCHAR(8) NOT NULL DEFAULT '16000',
+	alarm_ss1_L VARCHAR(8) NOT NULL DEFAULT '4000',
+	alarm_ss2_L VARCHAR(8) NOT NULL DEFAULT '4000',
+	alarm_ss3_L VARCHAR(8) NOT NULL DEFAULT '4000',
+	alarm_ss4_L VARCHAR(8) NOT NULL DEFAULT '4000',
+	alarm_ss5_L VARCHAR(8) NOT NULL DEFAULT '4000',
+	alarm_ss6_L VARCHAR(8) NOT NULL DEFAULT '4000',
+	Lat VARCHAR(20) NOT NULL DEFAULT '106.68929859995',
+	Lon VARCHAR(20) NOT NULL DEFAULT '10.798705000731',
+	Connection VARCHAR(16) NOT NULL DEFAULT 'DOWN',
+	Warning VARCHAR(256) NOT NULL DEFAULT 'Non',
+	RstCnt INTEGER NOT NULL DEFAULT 0,
+	SendFailed INTEGER NOT NULL DEFAULT 0,
+	TotalFrm INTEGER NOT NULL DEFAULT 0,
+	GSMRst INTEGER NOT NULL DEFAULT 0,
+	FWRev VARCHAR(8) NOT NULL DEFAULT 'Unknown',
+	QoS INTEGER NOT NULL DEFAULT 0,
+	"4ma_ss1" VARCHAR(8) NOT NULL DEFAULT '4000',
+	"20ma_ss1" VARCHAR(8) NOT NULL DEFAULT '20000',
+	"4ma_ss2" VARCHAR(8) NOT NULL DEFAULT '4000',
+	"20ma_ss2" VARCHAR(8) NOT NULL DEFAULT '20000',
+	"4ma_ss3" VARCHAR(8) NOT NULL DEFAULT '4000',
+	"20ma_ss3" VARCHAR(8) NOT NULL DEFAULT '20000',
+	"4ma_ss4" VARCHAR(8) NOT NULL DEFAULT '4000',
+	"20ma_ss4" VARCHAR(8) NOT NULL DEFAULT '20000',
+	"4ma_ss5" VARCHAR(8) NOT NULL DEFAULT '4000',
+	"20ma_ss5" VARCHAR(8) NOT NULL DEFAULT '20000',
+	"4ma_ss6" VARCHAR(8) NOT NULL DEFAULT '4000',
+	"20ma_ss6" VARCHAR(8) NOT NULL DEFAULT '20000',
+	"4ma_ss7" VARCHAR(8) NOT NULL DEFAULT '4000',
+	StartLogging TIMESTAMP(0),
+	EnableLogging VARCHAR(8) NOT NULL DEFAULT 'DISABLE',
+	EnableLogging2 VARCHAR(8) DEFAULT 'DISABLE',
+	"4ma_ss8" VARCHAR(8) NOT NULL DEFAULT '4000',
+	CMDCODE1 VARCHAR(128) DEFAULT 'NOCMD',
+	Reserve VARCHAR(16),
+	formula1 VARCHAR(1024),
+	formula2 VARCHAR(1024),
+	klr TEXT,
+	mmO2 TEXT,
+	Nm3 TEXT,
+	khoiluong TEXT,
+	muclong TEXT,
+	klr_2 TEXT,
+	mmO2_2 TEXT,
+	Nm3_2 TEXT,
+	khoiluong_2 TEXT,
+	muclong_2 TEXT,
+	sample_time INTEGER NOT NULL DEFAULT 1,
+	SendingRate INTEGER NOT NULL DEFAULT 1,
+	LastReport TIMESTAMP(0),
+	AI1_name VARCHAR(16) DEFAULT 'Sensor1',
+	AI2_name VARCHAR(16) NOT NULL DEFAULT 'Sensor2',
+	AI3_name CHAR(16) NOT NULL DEFAULT 'Sensor3',
+	AI4_name CHAR(16) NOT NULL DEFAULT 'Sensor4',
+	AI5_name CHAR(16) NOT NULL DEFAULT 'Sensor5',
+	AI6_name CHAR(16) NOT NULL DEFAULT 'Sensor6',
+	AI7_name VARCHAR(24),
+	AI8_name VARCHAR(24),
+	AI1_Unit VARCHAR(8),
+	AI2_Unit VARCHAR(8),
+	AI3_Unit VARCHAR(8),
+	AI4_Unit VARCHAR(8),
+	AI5_Unit VARCHAR(8),
+	AI6_Unit VARCHAR(8),
+	AI7_Unit VARCHAR(8),
+	AI8_Unit VARCHAR(8),
+	TempInside REAL NOT NULL DEFAULT 0,
+	TempOutside REAL NOT NULL DEFAULT 0,
+	MainPower REAL NOT NULL DEFAULT 0,
+	Battery REAL NOT NULL DEFAULT 0,
+	GSMSignal INTEGER NOT NULL DEFAULT 99,
+	CID_LAC VARCHAR(50) NOT NULL DEFAULT '0/0',
+	MNC VARCHAR(50) NOT NULL DEFAULT 'UNKNOWN',
+	DeviceEventCode VARCHAR(4) NOT NULL DEFAULT 'NEC',
+	AlarmEnable VARCHAR(10) NOT NULL DEFAULT 'ENABLE',
+	AlarmEnable2 VARCHAR(10) DEFAULT 'DISABLE',
+	DailyLatched VARCHAR(16) NOT NULL DEFAULT 'D_M_000',
+	MonthlyLatched VARCHAR(16) NOT NULL DEFAULT 'D_M_000',
+	MonthlyTotal BIGINT,
+	AlertEmailList2 VARCHAR(256),
+	AlertEmailList VARCHAR(256),
+	Sent_flag VARCHAR(16) DEFAULT '0',
+	Sent_flag2 VARCHAR(16) DEFAULT '0',
+	OnlineStatus VARCHAR(3) NOT NULL DEFAULT 'ONL',
+	BatteryStatus VARCHAR(3) NOT NULL DEFAULT 'OK',
+	HWRev VARCHAR(8),
+	NSX DATE,
+	DataServer VARCHAR(32),
+	BatteryUsage REAL,
+	BatteryUsageDate DATE,
+	BatteryInstallDate DATE,
+	alarm_muclong_L REAL DEFAULT -1,
+	alarm_muclong_H REAL DEFAULT 1000000000,
+	alarm_muclong_L2 REAL DEFAULT -1,
+	alarm_muclong_H2 REAL DEFAULT 1000000000,
+	UnBox VARCHAR(1),
+	offline_count INTEGER DEFAULT 0,
+	total_downtime_minutes INTEGER DEFAULT 0,
+	last_offline_start TIMESTAMP(0),
+	last_offline_end TIMESTAMP(0),
+	uptime_percentage NUMERIC(5,2) DEFAULT 100.00,
+	last_stats_update TIMESTAMP(0)
+);
+
+CREATE INDEX IF NOT EXISTS rdas_dev_devid ON rdas_dev (devID);
+
+CREATE INDEX IF NOT EXISTS rdas_dev_project ON rdas_dev (Project);
+
+CREATE TABLE IF NOT EXISTS sensor_data (
+	Idx BIGINT GENERATED BY DEFAULT AS IDENTITY NOT NULL,
+	deviceID VARCHAR(6) NOT NULL,
+	HWSerial VARCHAR(8),
+	status VARCHAR(48) NOT NULL,
+	sensor1 DOUBLE PRECISION,
+	sensor2 DOUBLE PRECISION,
+	sensor3 DOUBLE PRECISION,
+	sensor4 DOUBLE PRECISION,
+	sensor5 VARCHAR(12) NOT NULL,
+	sensor6 VARCHAR(12) NOT NULL,
+	sensor7 VARCHAR(12) NOT NULL,
+	sensor8 VARCHAR(12) NOT NULL,
+	TempInside VARCHAR(4) DEFAULT '',
+	TempOutside VARCHAR(4) DEFAULT '0',
+	MainPower REAL DEFAULT 0,
+	Battery REAL DEFAULT 0,
+	SensorPowerStatus VARCHAR(4) NOT NULL DEFAULT 'OF',
+	GSMSignal INTEGER NOT NULL DEFAULT 99,
+	"current_timestamp" TIMESTAMP(0) NOT NULL,
+	date_time TIMESTAMP(0) NOT NULL,
+	UnBox VARCHAR(2) NOT NULL,
+	Alert VARCHAR(32),
+	-- TimescaleDB requires the partitioning column in every unique index
+	PRIMARY KEY (Idx, date_time)
+);
+
+CREATE INDEX IF NOT EXISTS sensor_data_deviceid ON sensor_data (deviceID, date_time);
@@ -0,0 +1,20 @@
+-- alert is shared with the web application; the columns are the ones the
+-- converter writes.
+
+CREATE TABLE IF NOT EXISTS alert (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	EventTime TIMESTAMP(0) NOT NULL,
+	InsertTime TIMESTAMP(0) NOT NULL,
+	Source VARCHAR(16) NOT NULL,
+	Priority INTEGER NOT NULL DEFAULT 1,
+	Description VARCHAR(256) NOT NULL DEFAULT '',
+	AlertType VARCHAR(16) NOT NULL DEFAULT 'Device',
+	Project VARCHAR(50) NOT NULL DEFAULT '',
+	Type VARCHAR(16) NOT NULL DEFAULT 'Alert',
+	Status VARCHAR(4) NOT NULL DEFAULT 'V',
+	Note VARCHAR(256)
+);
+
+CREATE INDEX IF NOT EXISTS alert_eventtime ON alert (EventTime);
+
+CREATE INDEX IF NOT EXISTS alert_source ON alert (Source);
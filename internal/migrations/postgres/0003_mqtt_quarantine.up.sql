@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS mqtt_quarantine (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	topic VARCHAR(255) NOT NULL,
+	device_id VARCHAR(64) NOT NULL DEFAULT '',
+	payload BYTEA NOT NULL,
+	reason VARCHAR(255) NOT NULL,
+	received_at TIMESTAMP(0) NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'new',
+	reprocessed_at TIMESTAMP(0)
+);
+
+CREATE INDEX IF NOT EXISTS mqtt_quarantine_received_at ON mqtt_quarantine (received_at);
+
+CREATE INDEX IF NOT EXISTS mqtt_quarantine_device_id ON mqtt_quarantine (device_id);
@@ -2,9 +2,10 @@ package internal
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
-	"strings"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -12,7 +13,7 @@ import (
 
 func SetupMQTT(config Config, db *sql.DB) {
 	// MQTT setup
-	log.Println("Configuring MQTT client...")
+	slog.Info("Configuring MQTT client...")
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(fmt.Sprintf("%s://%s:%d", config.MQTT.Protocol, config.MQTT.Host, config.MQTT.Port))
 	opts.SetUsername(config.MQTT.User)
@@ -21,42 +22,74 @@ func SetupMQTT(config Config, db *sql.DB) {
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetryInterval(10 * time.Second)    // Retry mỗi 10 giây ban đầu
 	opts.SetMaxReconnectInterval(30 * 24 * time.Hour) // Tăng lên tối đa 1 tháng giữa các lần retry
+	var lost atomic.Bool
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		slog.Warn("MQTT connection lost", "error", err)
+		metricMQTTLost.inc()
+		lost.Store(true)
+	})
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if lost.Swap(false) {
+			slog.Info("Reconnected to MQTT broker.")
+			metricMQTTReconnects.inc()
+		}
+	})
 
 	var client mqtt.Client
 	for {
 		client = mqtt.NewClient(opts)
-		log.Println("Connecting to MQTT broker...")
+		slog.Info("Connecting to MQTT broker...")
 		if token := client.Connect(); token.Wait() && token.Error() != nil {
-			log.Printf("MQTT connection failed: %v. Retrying in 5 seconds...", token.Error())
+			slog.Error("MQTT connection failed, retrying in 5 seconds", "error", token.Error())
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		log.Println("Connected to MQTT broker successfully.")
+		slog.Info("Connected to MQTT broker successfully.")
+		setMQTTClient(client)
 		break
 	}
 	// defer client.Disconnect(250) // REMOVED: Don't disconnect immediately
 
 	// Subscribe to topic
-	log.Printf("Subscribing to topic: %s", config.MQTT.Topic)
+	slog.Info("Subscribing to topic", "topic", config.MQTT.Topic)
 	for {
 		token := client.Subscribe(config.MQTT.Topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-			log.Printf("DEBUG: Callback triggered for topic %s", msg.Topic())
-			log.Printf("Received message on topic %s: %s", msg.Topic(), string(msg.Payload()))
-			if strings.Contains(msg.Topic(), "telemetry") {
-				ProcessTelemetryMessage(db, msg)
-			} else if strings.Contains(msg.Topic(), "attributes") {
-				ProcessAttributesMessage(db, msg)
-			} else {
-				log.Printf("DEBUG: Topic %s does not contain 'telemetry' or 'attributes'", msg.Topic())
+			slog.Debug("Received message", "topic", msg.Topic(), "payload", string(msg.Payload()))
+			stats.message(msg.Topic())
+			if err := dispatchMessage(db, msg); err == errUnknownTopic {
+				slog.Debug("Topic does not contain 'telemetry' or 'attributes'", "topic", msg.Topic())
 			}
 		})
 		token.Wait()
 		if token.Error() != nil {
-			log.Printf("Subscription failed: %v. Retrying in 5 seconds...", token.Error())
+			slog.Error("Subscription failed, retrying in 5 seconds", "topic", config.MQTT.Topic, "error", token.Error())
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		log.Println("Subscription successful. Waiting for messages...")
+		slog.Info("Subscription successful. Waiting for messages...")
 		break
 	}
 }
+
+var (
+	errUnknownTopic = errors.New("topic is neither telemetry nor attributes")
+	errNotProcessed = errors.New("message was refused, quarantined or not fully written, see the device log")
+)
+
+// dispatchMessage routes a message to its handler by topic. It returns nil
+// only if the handler processed the message completely.
+func dispatchMessage(db *sql.DB, msg mqtt.Message) error {
+	var processed bool
+	switch topicKind(msg.Topic()) {
+	case "telemetry":
+		processed = ProcessTelemetryMessage(db, msg)
+	case "attributes":
+		processed = ProcessAttributesMessage(db, msg)
+	default:
+		return errUnknownTopic
+	}
+	if !processed {
+		return errNotProcessed
+	}
+	return nil
+}
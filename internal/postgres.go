@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresStore runs the store statements on PostgreSQL, optionally with
+// sensor_data as a TimescaleDB hypertable. The tables are created by the
+// migrations in migrations/postgres with unquoted, so lower case, names.
+// Datetimes are TIMESTAMP columns holding local time like the MySQL DATETIME
+// ones, and are read back as text in the same format.
+
+const pgDateTime = "to_char(%s, 'YYYY-MM-DD HH24:MI:SS')"
+
+// sqlDriver is the sql.driver of config.yaml, set by SetupDatabase.
+var sqlDriver = "mysql"
+
+type postgresStore struct {
+	db *sql.DB
+}
+
+// mysqlOnlyFeatures returns the enabled sections whose statements are MySQL
+// only; migrations/postgres has no tables for them either.
+func mysqlOnlyFeatures(config Config) []string {
+	var features []string
+	if config.Rollup.Enabled {
+		features = append(features, "rollup")
+	}
+	if config.Totalizer.Enabled {
+		features = append(features, "totalizer")
+	}
+	if config.Archive.Enabled {
+		features = append(features, "archive")
+	}
+	return features
+}
+
+// errMySQLOnly is returned by the rollup, totalizer and archive functions on
+// PostgreSQL.
+func errMySQLOnly(feature string) error {
+	if sqlDriver != "postgres" {
+		return nil
+	}
+	return fmt.Errorf("%s is not supported with sql.driver postgres", feature)
+}
+
+// rebind turns the ? placeholders of a statement into $1, $2, ... on
+// PostgreSQL. Statements passed to it must not contain ? in literals.
+func rebind(query string) string {
+	if sqlDriver != "postgres" || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *postgresStore) InsertReading(r Reading, ignoreDuplicate bool) (bool, error) {
+	query := `INSERT INTO sensor_data (deviceID, status, sensor1, sensor2, sensor3, sensor4, sensor5, sensor6, sensor7, sensor8, SensorPowerStatus, GSMSignal, "current_timestamp", date_time, UnBox)
+		VALUES ($1, 'active', $2, $3, $4, $5, '0', '0', '0', '0', 'ON', 0, NOW(), $6, $7)`
+	if ignoreDuplicate {
+		query += " ON CONFLICT DO NOTHING"
+	}
+	res, err := execSQL(s.db, "insert_sensor_data", r.DeviceID, query,
+		r.DeviceID, r.Sensors[0], r.Sensors[1], r.Sensors[2], r.Sensors[3], r.Time.Format(sqlDateTime), r.UnBox)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *postgresStore) UpdateDevice(deviceID string, state DeviceState) (int64, error) {
+	operation, query, args := updateDeviceQuery(deviceID, state)
+	res, err := execSQL(s.db, operation, deviceID, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *postgresStore) LatestData(deviceID string) (string, bool, error) {
+	var latest sql.NullString
+	err := s.db.QueryRow("SELECT "+fmt.Sprintf(pgDateTime, "LatestData")+" FROM rdas_dev WHERE devID = $1", deviceID).Scan(&latest)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return latest.String, err == nil, err
+}
+
+func (s *postgresStore) DeviceExists(deviceID string) (bool, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM rdas_dev WHERE devID = $1", deviceID).Scan(&count)
+	return count > 0, err
+}
+
+func (s *postgresStore) CreateDevice(deviceID string, tmpl DeviceTemplate) error {
+	columns, args := deviceTemplateValues(deviceID, tmpl)
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, col := range columns {
+		// Template columns such as 4mA_ss1 need quotes, which make the name
+		// case-sensitive
+		quoted[i] = `"` + strings.ToLower(strings.ReplaceAll(col, `"`, `""`)) + `"`
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	query := fmt.Sprintf("INSERT INTO rdas_dev (%s) VALUES (%s)", strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	_, err := execSQL(s.db, "create_device", deviceID, query, args...)
+	return err
+}
+
+func (s *postgresStore) Totalizers(deviceID string) (float64, float64, error) {
+	var t1, t2 float64
+	err := s.db.QueryRow("SELECT Totalizer1, Totalizer2 FROM rdas_dev WHERE devID = $1", deviceID).Scan(&t1, &t2)
+	return t1, t2, err
+}
+
+func (s *postgresStore) UpdateTotals(deviceID string, t DeviceTotals) error {
+	_, err := execSQL(s.db, "update_totals", deviceID, "UPDATE rdas_dev SET Totalizer1 = $1, Totalizer2 = $2, DailyLatched = COALESCE(NULLIF($3, ''), DailyLatched), MonthlyLatched = COALESCE(NULLIF($4, ''), MonthlyLatched), MonthlyTotal = $5 WHERE devID = $6",
+		t.Totalizer1, t.Totalizer2, t.DailyLatched, t.MonthlyLatched, t.MonthlyTotal, deviceID)
+	return err
+}
+
+func (s *postgresStore) InsertAlert(a Alert) error {
+	eventTime := "NOW()"
+	args := []interface{}{}
+	if !a.EventTime.IsZero() {
+		eventTime = "?"
+		args = append(args, a.EventTime.Format(sqlDateTime))
+	}
+	args = append(args, a.Source, a.Priority, a.Description, a.Project, a.Note)
+	_, err := execSQL(s.db, "insert_alert", a.Source, "INSERT INTO alert (EventTime, InsertTime, Source, Priority, Description, AlertType, Project, Type, Status, Note) VALUES ("+eventTime+", NOW(), ?, ?, ?, 'Device', ?, 'Alert', 'V', ?)", args...)
+	return err
+}
+
+func (s *postgresStore) Devices(deviceID string) ([]Device, error) {
+	query := "SELECT devID, Name, Project, " + fmt.Sprintf(pgDateTime, "LatestData") + ", Current_ss1, Current_ss2, Current_ss3, Current_ss4, UnBox, MainPower, GSMSignal FROM rdas_dev"
+	var args []interface{}
+	if deviceID != "" {
+		query += " WHERE devID = $1"
+		args = append(args, deviceID)
+	}
+	rows, err := s.db.Query(query+" ORDER BY devID", args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDevices(rows)
+}
+
+func (s *postgresStore) LatestReading(deviceID string) (Reading, bool, error) {
+	readings, err := queryReadings(s.db, "SELECT deviceID, "+fmt.Sprintf(pgDateTime, "date_time")+", sensor1, sensor2, sensor3, sensor4, UnBox FROM sensor_data WHERE deviceID = $1 ORDER BY date_time DESC LIMIT 1", deviceID)
+	if err != nil || len(readings) == 0 {
+		return Reading{}, false, err
+	}
+	return readings[0], true, nil
+}
+
+func (s *postgresStore) History(deviceID string, from, to time.Time, limit, offset int) ([]Reading, error) {
+	return queryReadings(s.db, "SELECT deviceID, "+fmt.Sprintf(pgDateTime, "date_time")+", sensor1, sensor2, sensor3, sensor4, UnBox FROM sensor_data WHERE deviceID = $1 AND date_time >= $2 AND date_time < $3 ORDER BY date_time, Idx LIMIT $4 OFFSET $5",
+		deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime), limit, offset)
+}
+
+// Aggregate buckets date_time by its epoch as if it were UTC, which is the
+// local wall clock, so intervals are aligned in the configured timezone.
+func (s *postgresStore) Aggregate(deviceID string, from, to time.Time, interval time.Duration) ([]Aggregate, error) {
+	secs := int64(interval / time.Second)
+	if secs <= 0 {
+		return nil, fmt.Errorf("interval must be at least 1s")
+	}
+	rows, err := s.db.Query(`SELECT FLOOR(EXTRACT(EPOCH FROM date_time) / $1)::BIGINT AS b, COUNT(*),
+		MIN(sensor1), MIN(sensor2), MIN(sensor3), MIN(sensor4),
+		MAX(sensor1), MAX(sensor2), MAX(sensor3), MAX(sensor4),
+		AVG(sensor1), AVG(sensor2), AVG(sensor3), AVG(sensor4)
+		FROM sensor_data WHERE deviceID = $2 AND date_time >= $3 AND date_time < $4
+		GROUP BY b ORDER BY b`,
+		secs, deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime))
+	if err != nil {
+		return nil, err
+	}
+	return scanAggregates(rows, secs)
+}
+
+func (s *postgresStore) Alerts(from, to time.Time, source, project string) ([]Alert, error) {
+	query := "SELECT " + fmt.Sprintf(pgDateTime, "EventTime") + ", Source, Priority, Description, Project, Note FROM alert WHERE EventTime >= ? AND EventTime < ?"
+	args := []interface{}{from.Format(sqlDateTime), to.Format(sqlDateTime)}
+	if source != "" {
+		query += " AND Source = ?"
+		args = append(args, source)
+	}
+	if project != "" {
+		query += " AND Project = ?"
+		args = append(args, project)
+	}
+	rows, err := s.db.Query(rebind(query+" ORDER BY EventTime"), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAlerts(rows)
+}
+
+// EnableTimescale turns sensor_data into a TimescaleDB hypertable partitioned
+// by date_time, moving existing rows. It does nothing if it already is one.
+func EnableTimescale(db *sql.DB) error {
+	if _, err := execSQL(db, "enable_timescale", "", "CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		return err
+	}
+	_, err := execSQL(db, "enable_timescale", "", "SELECT create_hypertable('sensor_data', 'date_time', if_not_exists => TRUE, migrate_data => TRUE)")
+	return err
+}
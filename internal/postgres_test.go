@@ -0,0 +1,26 @@
+package internal
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		driver string
+		query  string
+		want   string
+	}{
+		{"mysql", "SELECT * FROM rdas_dev WHERE devID = ?", "SELECT * FROM rdas_dev WHERE devID = ?"},
+		{"postgres", "SELECT * FROM rdas_dev", "SELECT * FROM rdas_dev"},
+		{"postgres", "SELECT * FROM rdas_dev WHERE devID = ?", "SELECT * FROM rdas_dev WHERE devID = $1"},
+		{"postgres", "INSERT INTO alert (EventTime, Source, Note) VALUES (NOW(), ?, ?)", "INSERT INTO alert (EventTime, Source, Note) VALUES (NOW(), $1, $2)"},
+		{"postgres", "UPDATE t SET a = ?, b = ? WHERE c = ? AND d = ? AND e = ? AND f = ? AND g = ? AND h = ? AND i = ? AND j = ?",
+			"UPDATE t SET a = $1, b = $2 WHERE c = $3 AND d = $4 AND e = $5 AND f = $6 AND g = $7 AND h = $8 AND i = $9 AND j = $10"},
+		{"postgres", "SELECT 'Đà Nẵng' WHERE x = ?", "SELECT 'Đà Nẵng' WHERE x = $1"},
+	}
+	defer func(d string) { sqlDriver = d }(sqlDriver)
+	for _, tt := range tests {
+		sqlDriver = tt.driver
+		if got := rebind(tt.query); got != tt.want {
+			t.Errorf("rebind(%q) with %s = %q, want %q", tt.query, tt.driver, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+)
+
+const (
+	unknownIgnore = "ignore"
+	unknownWarn   = "warn"
+	unknownCreate = "create"
+
+	maxWarned = 10000
+)
+
+var (
+	unknownPolicy = unknownWarn
+	deviceTmpl    DeviceTemplate
+
+	provisionMu sync.Mutex
+	// warnedDevice is bounded like the dedup cache so that a stream of
+	// random device IDs cannot grow it without limit.
+	warnedDevice = newDedupCache(maxWarned)
+
+	columnNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+type DeviceTemplate struct {
+	UserID  int               `yaml:"user_id"`
+	Project string            `yaml:"project"`
+	Type    string            `yaml:"type"`
+	Columns map[string]string `yaml:"columns"`
+}
+
+func SetupProvisioning(config Config) {
+	switch config.UnknownDevice.Policy {
+	case "":
+	case unknownIgnore, unknownWarn, unknownCreate:
+		unknownPolicy = config.UnknownDevice.Policy
+	default:
+		slog.Warn("Unknown unknown_device.policy, using the default", "policy", config.UnknownDevice.Policy, "default", unknownPolicy)
+	}
+	deviceTmpl = config.UnknownDevice.Template
+	if deviceTmpl.Project == "" {
+		deviceTmpl.Project = "SOVIGAZ"
+	}
+	if deviceTmpl.Type == "" {
+		deviceTmpl.Type = "MQTT"
+	}
+	for col := range deviceTmpl.Columns {
+		if !columnNameRe.MatchString(col) {
+			slog.Warn("Ignoring invalid column name in unknown_device.template.columns", "column", col)
+			delete(deviceTmpl.Columns, col)
+		}
+	}
+	slog.Info("Unknown device policy", "policy", unknownPolicy)
+}
+
+// ensureDevice is called when an rdas_dev UPDATE matched no row. It applies
+// the unknown device policy and reports whether the device row exists now,
+// in which case the caller should retry its UPDATE.
+func ensureDevice(deviceID string) bool {
+	switch unknownPolicy {
+	case unknownIgnore:
+		return false
+	case unknownWarn:
+		if !warnedDevice.seen(deviceID) {
+			slog.Warn("Device publishes data but has no rdas_dev row", "deviceID", deviceID)
+		}
+		return false
+	}
+
+	provisionMu.Lock()
+	defer provisionMu.Unlock()
+
+	// Another message of the same device may have created the row meanwhile
+	exists, err := store.DeviceExists(deviceID)
+	if err != nil {
+		slog.Error("Checking rdas_dev failed", "deviceID", deviceID, "error", err)
+		return false
+	}
+	if exists {
+		return true
+	}
+
+	if err := store.CreateDevice(deviceID, deviceTmpl); err != nil {
+		return false
+	}
+	slog.Info("Created rdas_dev row for new device", "deviceID", deviceID, "project", deviceTmpl.Project)
+	registry.remember(deviceID, deviceTmpl.Project)
+
+	description := fmt.Sprintf("Device>Info:THIET BI MOI %s LUC %s", deviceID, localNow().Format("15:04:05 02_01_2006"))
+	if err := store.InsertAlert(Alert{Source: deviceID, Priority: 2, Description: description, Project: deviceTmpl.Project, Note: "New device"}); err == nil {
+		slog.Info("Inserted new device alert", "deviceID", deviceID)
+		metricAlerts.inc("new_device")
+		hub.publish(StreamEvent{Type: "alert", DeviceID: deviceID, Project: deviceTmpl.Project, ReadingTime: localNow().Format("2006-01-02 15:04:05"), Alert: description})
+	}
+	return true
+}
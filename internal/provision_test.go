@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWarnedDeviceBounded(t *testing.T) {
+	defer func(c *dedupCache) { warnedDevice = c }(warnedDevice)
+	defer func(p string) { unknownPolicy = p }(unknownPolicy)
+	warnedDevice = newDedupCache(3)
+	unknownPolicy = unknownWarn
+
+	for i := 0; i < 10; i++ {
+		if ensureDevice(fmt.Sprintf("dev%d", i)) {
+			t.Fatalf("ensureDevice(dev%d) = true with policy warn", i)
+		}
+	}
+	if n := warnedDevice.order.Len(); n != 3 {
+		t.Errorf("warned devices = %d, want 3", n)
+	}
+	if !warnedDevice.seen("dev9") {
+		t.Error("most recent device was evicted")
+	}
+	if warnedDevice.seen("dev0") {
+		t.Error("oldest device was not evicted")
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Messages that could not be processed or were rejected are kept in the
+// mqtt_quarantine table so they can be inspected, fixed and fed back through
+// the normal path.
+
+type QuarantinedMessage struct {
+	ID            int64
+	Topic         string
+	DeviceID      string
+	Payload       []byte
+	Reason        string
+	ReceivedAt    string
+	Status        string
+	ReprocessedAt sql.NullString
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// quarantineMessage stores a raw message that was not written to sensor_data
+// or rdas_dev.
+func quarantineMessage(db *sql.DB, topic, deviceID string, payload []byte, reason string) {
+	_, err := execSQL(db, "insert_quarantine", deviceID, "INSERT INTO mqtt_quarantine (topic, device_id, payload, reason, received_at) VALUES (?, ?, ?, ?, ?)",
+		truncate(topic, 255), truncate(deviceID, 64), payload, truncate(reason, 255), localNow().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return
+	}
+	slog.Warn("Quarantined message", "deviceID", deviceID, "topic", topic, "reason", reason)
+	stats.count("quarantined")
+}
+
+func ListQuarantine(db *sql.DB, deviceID, status string, limit int) ([]QuarantinedMessage, error) {
+	var where []string
+	var args []interface{}
+	if deviceID != "" {
+		where = append(where, "device_id = ?")
+		args = append(args, deviceID)
+	}
+	if status != "" {
+		where = append(where, "status = ?")
+		args = append(args, status)
+	}
+	query := "SELECT id, topic, device_id, payload, reason, received_at, status, reprocessed_at FROM mqtt_quarantine"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := db.Query(rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []QuarantinedMessage
+	for rows.Next() {
+		var m QuarantinedMessage
+		if err := rows.Scan(&m.ID, &m.Topic, &m.DeviceID, &m.Payload, &m.Reason, &m.ReceivedAt, &m.Status, &m.ReprocessedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func GetQuarantined(db *sql.DB, id int64) (QuarantinedMessage, error) {
+	var m QuarantinedMessage
+	err := db.QueryRow(rebind("SELECT id, topic, device_id, payload, reason, received_at, status, reprocessed_at FROM mqtt_quarantine WHERE id = ?"), id).
+		Scan(&m.ID, &m.Topic, &m.DeviceID, &m.Payload, &m.Reason, &m.ReceivedAt, &m.Status, &m.ReprocessedAt)
+	if err == sql.ErrNoRows {
+		return m, fmt.Errorf("quarantined message %d not found", id)
+	}
+	return m, err
+}
+
+// ReprocessQuarantined feeds a quarantined message through the same handlers
+// as live MQTT messages. topic and payload replace the stored values when
+// non-empty, which allows fixing a message before reprocessing it. The
+// message is marked reprocessed only if it was processed completely; if it
+// is quarantined again, that is under a new id. A message already
+// reprocessed is refused unless force is set, since its readings would be
+// written twice.
+func ReprocessQuarantined(db *sql.DB, id int64, topic string, payload []byte, force bool) error {
+	m, err := GetQuarantined(db, id)
+	if err != nil {
+		return err
+	}
+	if m.Status == "reprocessed" && !force {
+		return fmt.Errorf("message %d was already reprocessed at %s; use -force to process it again", id, m.ReprocessedAt.String)
+	}
+	if topic == "" {
+		topic = m.Topic
+	}
+	if payload == nil {
+		payload = m.Payload
+	}
+	slog.Info("Reprocessing quarantined message", "id", id, "topic", topic)
+	if err := dispatchMessage(db, &storedMessage{topic: topic, payload: payload}); err != nil {
+		return fmt.Errorf("%s: %w", topic, err)
+	}
+	_, err = db.Exec(rebind("UPDATE mqtt_quarantine SET status = 'reprocessed', reprocessed_at = ? WHERE id = ?"), localNow().Format("2006-01-02 15:04:05"), id)
+	return err
+}
+
+// PurgeQuarantine deletes the given ids, or every message received before
+// olderThan when no ids are given.
+func PurgeQuarantine(db *sql.DB, ids []int64, olderThan time.Duration) (int64, error) {
+	var res sql.Result
+	var err error
+	if len(ids) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+		args := make([]interface{}, len(ids))
+		for i, id := range ids {
+			args[i] = id
+		}
+		res, err = db.Exec(rebind("DELETE FROM mqtt_quarantine WHERE id IN ("+placeholders+")"), args...)
+	} else {
+		cutoff := localNow().Add(-olderThan).Format("2006-01-02 15:04:05")
+		res, err = db.Exec(rebind("DELETE FROM mqtt_quarantine WHERE received_at < ?"), cutoff)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// storedMessage lets a message read back from the database go through the
+// handlers that expect an mqtt.Message.
+type storedMessage struct {
+	topic   string
+	payload []byte
+}
+
+var _ mqtt.Message = (*storedMessage)(nil)
+
+func (m *storedMessage) Duplicate() bool   { return false }
+func (m *storedMessage) Qos() byte         { return 0 }
+func (m *storedMessage) Retained() bool    { return false }
+func (m *storedMessage) Topic() string     { return m.topic }
+func (m *storedMessage) MessageID() uint16 { return 0 }
+func (m *storedMessage) Payload() []byte   { return m.payload }
+func (m *storedMessage) Ack()              {}
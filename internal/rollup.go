@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// sensor_rollup_hour and sensor_rollup_day summarize sensor_data per device
+// and local hour or day. They are updated with every inserted reading and
+// keep sums and counts of the non-NULL values rather than averages so that
+// readings can be added one by one. Migration 0004 creates them.
+//
+// sensor_rollup_coverage records per device, or for every device under '',
+// the range the rollups are known to be complete for: what a rebuild
+// recomputed, extended while the service keeps them up to date. Aggregate
+// queries outside it read sensor_data.
+
+var rollupTables = map[string]string{
+	"hour": "sensor_rollup_hour",
+	"day":  "sensor_rollup_day",
+}
+
+// rollupHeartbeat is how often the service extends the coverage it keeps up
+// to date.
+const rollupHeartbeat = time.Minute
+
+// SetupRollups makes ingestion maintain the rollup tables and aggregate
+// queries read them.
+func SetupRollups(config Config) {
+	if !config.Rollup.Enabled {
+		return
+	}
+	s, ok := store.(*mysqlStore)
+	if !ok {
+		slog.Error("Rollup tables disabled", "error", errMySQLOnly("rollup"))
+		return
+	}
+	s.rollups = true
+	s.liveSince = localNow()
+	slog.Info("Rollup tables enabled")
+}
+
+// StartRollupMaintenance rebuilds the days since the recorded coverage ends,
+// which were not maintained while the service was stopped, and then keeps
+// extending the coverage to now.
+func StartRollupMaintenance(db *sql.DB) {
+	s, ok := store.(*mysqlStore)
+	if !ok || !s.rollups {
+		return
+	}
+	go func() {
+		coverage, err := rollupCoverage(db)
+		if err != nil {
+			slog.Error("Reading rollup coverage failed", "error", err)
+		}
+		if len(coverage) == 0 && err == nil {
+			slog.Warn("Aggregate queries read sensor_data until `main rollup rebuild` has run")
+		}
+		for deviceID, c := range coverage {
+			days, err := RebuildRollups(db, deviceID, c[1], localNow())
+			if err != nil {
+				slog.Error("Catching up rollups failed", "deviceID", deviceID, "from", c[1].Format(sqlDateTime), "error", err)
+				continue
+			}
+			slog.Info("Caught up rollups", "deviceID", deviceID, "from", c[1].Format(sqlDateTime), "days", days)
+		}
+		for range time.Tick(rollupHeartbeat) {
+			// Only ranges reaching into the time this process maintains the
+			// rollups are contiguous with it
+			now := localNow().Format(sqlDateTime)
+			execSQL(db, "extend_rollup_coverage", "", "UPDATE sensor_rollup_coverage SET covered_to = ? WHERE covered_to >= ? AND covered_to < ?",
+				now, s.liveSince.Format(sqlDateTime), now)
+		}
+	}()
+}
+
+// rollupCoverage returns the recorded from and to of each device.
+func rollupCoverage(db *sql.DB) (map[string][2]time.Time, error) {
+	rows, err := db.Query("SELECT deviceID, covered_from, covered_to FROM sensor_rollup_coverage")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	coverage := make(map[string][2]time.Time)
+	for rows.Next() {
+		var deviceID, from, to string
+		if err := rows.Scan(&deviceID, &from, &to); err != nil {
+			return nil, err
+		}
+		var c [2]time.Time
+		for i, v := range []string{from, to} {
+			if c[i], err = time.ParseInLocation(sqlDateTime, v, location); err != nil {
+				return nil, err
+			}
+		}
+		coverage[deviceID] = c
+	}
+	return coverage, rows.Err()
+}
+
+// rollupBucket is the start of the local hour or day containing t.
+func rollupBucket(period string, t time.Time) time.Time {
+	t = t.In(location)
+	if period == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, location)
+}
+
+// insertWithRollups inserts a reading and adds it to its hour and day in one
+// transaction, so that a rebuild, which locks the readings of the day it
+// recomputes, neither misses the reading nor counts it twice.
+func (s *mysqlStore) insertWithRollups(r Reading, query string, args []interface{}) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := execSQL(tx, "insert_sensor_data", r.DeviceID, query, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, tx.Commit()
+	}
+	for _, period := range []string{"hour", "day"} {
+		// Columns are assigned left to right, so last1..4 are compared with
+		// the old last_time before it is updated. LEAST and GREATEST return
+		// NULL if min or max is, for a channel without values so far
+		query := "INSERT INTO " + rollupTables[period] + ` (deviceID, bucket, count, count1, count2, count3, count4, sum1, sum2, sum3, sum4, min1, min2, min3, min4, max1, max2, max3, max4, last_time, last1, last2, last3, last4)
+			VALUES (?, ?, 1, 1, 1, 1, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE count = count + 1,
+			count1 = count1 + 1, count2 = count2 + 1, count3 = count3 + 1, count4 = count4 + 1,
+			sum1 = sum1 + VALUES(sum1), sum2 = sum2 + VALUES(sum2), sum3 = sum3 + VALUES(sum3), sum4 = sum4 + VALUES(sum4),
+			min1 = LEAST(COALESCE(min1, VALUES(min1)), VALUES(min1)), min2 = LEAST(COALESCE(min2, VALUES(min2)), VALUES(min2)),
+			min3 = LEAST(COALESCE(min3, VALUES(min3)), VALUES(min3)), min4 = LEAST(COALESCE(min4, VALUES(min4)), VALUES(min4)),
+			max1 = GREATEST(COALESCE(max1, VALUES(max1)), VALUES(max1)), max2 = GREATEST(COALESCE(max2, VALUES(max2)), VALUES(max2)),
+			max3 = GREATEST(COALESCE(max3, VALUES(max3)), VALUES(max3)), max4 = GREATEST(COALESCE(max4, VALUES(max4)), VALUES(max4)),
+			last1 = IF(VALUES(last_time) >= last_time, VALUES(last1), last1), last2 = IF(VALUES(last_time) >= last_time, VALUES(last2), last2),
+			last3 = IF(VALUES(last_time) >= last_time, VALUES(last3), last3), last4 = IF(VALUES(last_time) >= last_time, VALUES(last4), last4),
+			last_time = GREATEST(last_time, VALUES(last_time))`
+		v := r.Sensors
+		args := []interface{}{r.DeviceID, rollupBucket(period, r.Time).Format(sqlDateTime),
+			v[0], v[1], v[2], v[3], // sum
+			v[0], v[1], v[2], v[3], // min
+			v[0], v[1], v[2], v[3], // max
+			r.Time.Format(sqlDateTime), v[0], v[1], v[2], v[3]}
+		if _, err := execSQL(tx, "upsert_rollup_"+period, r.DeviceID, query, args...); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// isLockConflict reports whether a MySQL error is a deadlock or lock wait
+// timeout, after which the transaction can be retried.
+func isLockConflict(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1213 || mysqlErr.Number == 1205)
+}
+
+// RebuildRollups recomputes the rollups of the local days from from to to,
+// one day per transaction, from sensor_data, and records the range as
+// covered. An empty deviceID rebuilds every device. The range starts at the
+// oldest reading at the earliest, so the rollups of months whose readings
+// were archived are kept. Readings of a day cannot be inserted while it is
+// rebuilt.
+func RebuildRollups(db *sql.DB, deviceID string, from, to time.Time) (int, error) {
+	if err := errMySQLOnly("rollup"); err != nil {
+		return 0, err
+	}
+	if now := localNow(); to.After(now) {
+		to = now
+	}
+	var oldest sql.NullString
+	query, args := "SELECT MIN(date_time) FROM sensor_data", []interface{}{}
+	if deviceID != "" {
+		query += " WHERE deviceID = ?"
+		args = append(args, deviceID)
+	}
+	if err := db.QueryRow(query, args...).Scan(&oldest); err != nil {
+		return 0, err
+	}
+	first := to
+	if oldest.Valid {
+		t, err := time.ParseInLocation(sqlDateTime, oldest.String, location)
+		if err != nil {
+			return 0, err
+		}
+		first = rollupBucket("day", t)
+	}
+	if from.Before(first) {
+		if !from.IsZero() {
+			slog.Info("Rollups before the oldest reading in sensor_data are kept", "deviceID", deviceID, "from", first.Format(sqlDateTime))
+		}
+		from = first
+	}
+	days := 0
+	for day := rollupBucket("day", from); !day.After(to); day = day.AddDate(0, 0, 1) {
+		end := day.AddDate(0, 0, 1)
+		covered := end
+		if covered.After(to) {
+			covered = to
+		}
+		if err := rebuildRollupDay(db, deviceID, day, end, covered); err != nil {
+			return days, fmt.Errorf("rebuilding %s: %w", day.Format("2006-01-02"), err)
+		}
+		days++
+	}
+	return days, nil
+}
+
+// rebuildRollupDay recomputes the rollups from from to to and records them
+// as covered up to covered.
+func rebuildRollupDay(db *sql.DB, deviceID string, from, to, covered time.Time) error {
+	// Repeatable read makes the locking read below lock the gaps too, so
+	// that no reading of the day is inserted until the commit
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	where := "bucket >= ? AND bucket < ?"
+	args := []interface{}{from.Format(sqlDateTime), to.Format(sqlDateTime)}
+	if deviceID != "" {
+		where += " AND deviceID = ?"
+		args = append(args, deviceID)
+	}
+	dataWhere := strings.ReplaceAll(where, "bucket", "date_time")
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sensor_data WHERE "+dataWhere+" LOCK IN SHARE MODE", args...).Scan(&count); err != nil {
+		return err
+	}
+	for period, table := range rollupTables {
+		if _, err := execSQL(tx, "rebuild_rollup_"+period, deviceID, "DELETE FROM "+table+" WHERE "+where, args...); err != nil {
+			return err
+		}
+		bucket := "DATE_FORMAT(date_time, '%Y-%m-%d %H:00:00')"
+		if period == "day" {
+			bucket = "DATE(date_time)"
+		}
+		// NULL values are left out of the counts, sums, minimums and
+		// maximums, as AVG, MIN and MAX on sensor_data do
+		var columns []string
+		for _, f := range []string{"COUNT(sensor%d)", "COALESCE(SUM(sensor%d), 0)", "MIN(sensor%d)", "MAX(sensor%d)"} {
+			for ch := 1; ch <= 4; ch++ {
+				columns = append(columns, fmt.Sprintf(f, ch))
+			}
+		}
+		columns = append(columns, "MAX(date_time)")
+		// The first element of the list ordered newest first is the last value
+		for ch := 1; ch <= 4; ch++ {
+			columns = append(columns, fmt.Sprintf("SUBSTRING_INDEX(GROUP_CONCAT(COALESCE(sensor%d, 0) ORDER BY date_time DESC, Idx DESC), ',', 1) + 0", ch))
+		}
+		query := "INSERT INTO " + table + ` (deviceID, bucket, count, count1, count2, count3, count4, sum1, sum2, sum3, sum4, min1, min2, min3, min4, max1, max2, max3, max4, last_time, last1, last2, last3, last4)
+			SELECT deviceID, ` + bucket + ", COUNT(*), " + strings.Join(columns, ", ") + `
+			FROM sensor_data WHERE ` + dataWhere + `
+			GROUP BY deviceID, ` + bucket
+		if _, err := execSQL(tx, "rebuild_rollup_"+period, deviceID, query, args...); err != nil {
+			return err
+		}
+	}
+	if err := extendCoverage(tx, deviceID, from, covered); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// extendCoverage merges from..to into the recorded coverage of deviceID. A
+// range apart from the recorded one replaces it only if it ends later, since
+// the coverage that reaches now is the one kept up to date.
+func extendCoverage(tx *sql.Tx, deviceID string, from, to time.Time) error {
+	var oldFrom, oldTo string
+	err := tx.QueryRow("SELECT covered_from, covered_to FROM sensor_rollup_coverage WHERE deviceID = ? FOR UPDATE", deviceID).Scan(&oldFrom, &oldTo)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		f, err := time.ParseInLocation(sqlDateTime, oldFrom, location)
+		if err != nil {
+			return err
+		}
+		t, err := time.ParseInLocation(sqlDateTime, oldTo, location)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !from.After(t) && !to.Before(f):
+			if f.Before(from) {
+				from = f
+			}
+			if t.After(to) {
+				to = t
+			}
+		case t.After(to):
+			return nil
+		}
+	}
+	_, err = execSQL(tx, "rollup_coverage", deviceID, "REPLACE INTO sensor_rollup_coverage (deviceID, covered_from, covered_to) VALUES (?, ?, ?)",
+		deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime))
+	return err
+}
+
+// aggregateSource returns the table and expressions Aggregate reads: a
+// rollup table when the range and interval fall on its buckets and the range
+// is covered, else sensor_data.
+func (s *mysqlStore) aggregateSource(deviceID string, from, to time.Time, interval time.Duration) (table, timeColumn string, columns []string) {
+	period := ""
+	if s.rollups {
+		for _, p := range []string{"day", "hour"} {
+			size := time.Hour
+			if p == "day" {
+				size = 24 * time.Hour
+			}
+			if interval%size == 0 && rollupBucket(p, from).Equal(from) && rollupBucket(p, to).Equal(to) {
+				period = p
+				break
+			}
+		}
+	}
+	if period != "" {
+		var covered int
+		err := s.db.QueryRow("SELECT COUNT(*) FROM sensor_rollup_coverage WHERE deviceID IN (?, '') AND covered_from <= ? AND covered_to >= ?",
+			deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime)).Scan(&covered)
+		if err != nil {
+			slog.Warn("Reading rollup coverage failed, aggregating sensor_data", "deviceID", deviceID, "error", err)
+		}
+		if covered == 0 {
+			period = ""
+		}
+	}
+	if period == "" {
+		columns = append(columns, "COUNT(*)")
+		for _, f := range []string{"MIN(sensor%d)", "MAX(sensor%d)", "AVG(sensor%d)"} {
+			for ch := 1; ch <= 4; ch++ {
+				columns = append(columns, fmt.Sprintf(f, ch))
+			}
+		}
+		return "sensor_data", "date_time", columns
+	}
+	columns = append(columns, "SUM(count)")
+	for _, f := range []string{"MIN(min%d)", "MAX(max%d)", "SUM(sum%[1]d) / NULLIF(SUM(count%[1]d), 0)"} {
+		for ch := 1; ch <= 4; ch++ {
+			columns = append(columns, fmt.Sprintf(f, ch))
+		}
+	}
+	return rollupTables[period], "bucket", columns
+}
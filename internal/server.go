@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	mqttMu     sync.Mutex
+	mqttClient mqtt.Client
+)
+
+func setMQTTClient(client mqtt.Client) {
+	mqttMu.Lock()
+	mqttClient = client
+	mqttMu.Unlock()
+}
+
+func mqttConnected() bool {
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+	return mqttClient != nil && mqttClient.IsConnectionOpen()
+}
+
+// StartHTTPServer serves the health, readiness, status and metrics endpoints
+// on http.listen. It does nothing when no address is configured. The status,
+// dashboard, stream, API and Grafana endpoints need http.token when it is set.
+func StartHTTPServer(config Config, db *sql.DB) {
+	if config.HTTP.Listen == "" {
+		slog.Info("HTTP server disabled.")
+		return
+	}
+	mux := http.NewServeMux()
+	if config.HTTP.OfflineAfter > 0 {
+		offlineAfter = config.HTTP.OfflineAfter
+	}
+	if config.HTTP.Token == "" && !loopbackAddress(config.HTTP.Listen) {
+		slog.Warn("HTTP endpoints are served without authentication, set http.token", "address", config.HTTP.Listen)
+	}
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks := readiness(r.Context(), db)
+		status := http.StatusOK
+		for _, v := range checks {
+			if v != "ok" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		writeJSON(w, status, checks)
+	})
+	protected := http.NewServeMux()
+	if config.HTTP.Dashboard {
+		registerDashboard(protected)
+	}
+	if config.HTTP.Stream {
+		registerStream(protected, config.HTTP.AllowedOrigins)
+		// ?project= filters use the registry, so keep it current
+		registry.startRefresh(db, config.Authorization.RefreshInterval)
+	}
+	if config.HTTP.API {
+		registerAPI(protected)
+	}
+	if config.HTTP.Grafana {
+		registerGrafana(protected)
+	}
+	summary := configSummary(config)
+	protected.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, statusReport(summary))
+	})
+	mux.Handle("/", requireToken(config.HTTP.Token, protected))
+
+	server := &http.Server{
+		Addr:              config.HTTP.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("HTTP server listening", "address", config.HTTP.Listen)
+		if err := server.ListenAndServe(); err != nil {
+			slog.Error("HTTP server stopped", "address", config.HTTP.Listen, "error", err)
+		}
+	}()
+}
+
+// requireToken lets a request through to h only if it carries token, either
+// as "Authorization: Bearer <token>" or as the password of basic auth, which
+// browsers and Grafana can send. An empty token lets every request through.
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, got, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mqtt-converter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loopbackAddress reports whether a listen address only accepts local
+// connections.
+func loopbackAddress(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// readiness checks the MQTT connection and the database and returns "ok" or
+// the problem for each. There is no spool to check: messages are written to
+// the database from the MQTT callback and never buffered on disk.
+func readiness(ctx context.Context, db *sql.DB) map[string]string {
+	checks := map[string]string{"mqtt": "ok", "database": "ok"}
+	if !mqttConnected() {
+		checks["mqtt"] = "not connected"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+	}
+	return checks
+}
+
+func statusReport(summary map[string]interface{}) interface{} {
+	counters, devices := stats.snapshot()
+	counters["duplicates"] = int64(DuplicateCount())
+
+	type deviceStatus struct {
+		DeviceStats
+		ClockDrift string `json:"clock_drift,omitempty"`
+	}
+	drifts := ClockDrifts()
+	out := make([]deviceStatus, len(devices))
+	for i, d := range devices {
+		out[i].DeviceStats = d
+		if drift, ok := drifts[d.DeviceID]; ok {
+			out[i].ClockDrift = drift.Offset.Round(time.Second).String()
+		}
+	}
+	return struct {
+		Started  time.Time              `json:"started"`
+		Uptime   string                 `json:"uptime"`
+		MQTT     bool                   `json:"mqtt_connected"`
+		Counters map[string]int64       `json:"counters"`
+		Devices  []deviceStatus         `json:"devices"`
+		Config   map[string]interface{} `json:"config"`
+	}{
+		Started:  stats.started.In(location),
+		Uptime:   time.Since(stats.started).Round(time.Second).String(),
+		MQTT:     mqttConnected(),
+		Counters: counters,
+		Devices:  out,
+		Config:   summary,
+	}
+}
+
+// configSummary returns the configuration as it is written in config.yaml,
+// with passwords and the token redacted.
+func configSummary(config Config) map[string]interface{} {
+	for _, pass := range []*string{&config.MQTT.Pass, &config.SQL.Pass, &config.HTTP.Token} {
+		if *pass != "" {
+			*pass = redactedSecret
+		}
+	}
+	var summary map[string]interface{}
+	data, err := yaml.Marshal(config)
+	if err == nil {
+		err = yaml.Unmarshal(data, &summary)
+	}
+	if err != nil {
+		slog.Error("Summarizing config failed", "error", err)
+	}
+	return summary
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("Writing HTTP response failed", "error", err)
+	}
+}
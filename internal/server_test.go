@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		user   string
+		pass   string
+		want   int
+	}{
+		{"no token configured", "", "", "", "", http.StatusOK},
+		{"missing", "s3cret", "", "", "", http.StatusUnauthorized},
+		{"bearer", "s3cret", "Bearer s3cret", "", "", http.StatusOK},
+		{"wrong bearer", "s3cret", "Bearer s3cre", "", "", http.StatusUnauthorized},
+		{"basic auth password", "s3cret", "", "grafana", "s3cret", http.StatusOK},
+		{"wrong basic auth", "s3cret", "", "s3cret", "x", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/status", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := httptest.NewRecorder()
+		requireToken(tt.token, ok).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestLoopbackAddress(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"localhost:8080", true},
+		{"[::1]:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"10.0.0.5:8080", false},
+	}
+	for _, tt := range tests {
+		if got := loopbackAddress(tt.listen); got != tt.want {
+			t.Errorf("loopbackAddress(%q) = %v, want %v", tt.listen, got, tt.want)
+		}
+	}
+}
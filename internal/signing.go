@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type signingPolicy struct {
+	enabled      bool
+	required     bool
+	keyFile      string
+	keyTable     string
+	rejectionLog string
+}
+
+var (
+	signing = signingPolicy{rejectionLog: "log/rejected.log"}
+
+	keysMu     sync.RWMutex
+	deviceKeys = make(map[string][]byte)
+
+	// signingStop ends the key refresh started by SetupSigning
+	signingStop chan struct{}
+)
+
+// signedEnvelope is the payload format of a signed message. HMAC is the hex
+// HMAC-SHA256 of the exact bytes of Data under the device secret; Data is the
+// telemetry or attributes payload as it would be sent unsigned. The signature
+// cannot be sent as an MQTT v5 user property instead: paho.mqtt.golang v1.5
+// speaks MQTT 3.1.1 only, which has no properties, so such a message arrives
+// as unsigned.
+type signedEnvelope struct {
+	Data json.RawMessage `json:"data"`
+	HMAC string          `json:"hmac"`
+}
+
+func SetupSigning(config Config, db *sql.DB) error {
+	c := config.Signing
+	if !c.Enabled {
+		slog.Info("Payload signature verification disabled.")
+		return nil
+	}
+	signing.enabled = true
+	signing.required = c.Required
+	signing.keyFile = c.KeyFile
+	signing.keyTable = c.KeyTable
+	if c.RejectionLog != "" {
+		signing.rejectionLog = c.RejectionLog
+	}
+	if signing.keyTable != "" && !columnNameRe.MatchString(signing.keyTable) {
+		slog.Warn("Invalid signing.key_table, ignoring it", "table", signing.keyTable)
+		signing.keyTable = ""
+	}
+
+	// Without keys every message from a device with a key would be accepted
+	// unverified, or rejected when required
+	if err := loadDeviceKeys(db); err != nil {
+		return err
+	}
+	interval := c.RefreshInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	StopSigning()
+	signingStop = make(chan struct{})
+	go refreshDeviceKeys(db, interval, signingStop)
+	slog.Info("Payload signature verification enabled", "required", signing.required, "rejectionLog", signing.rejectionLog)
+	return nil
+}
+
+// StopSigning ends the periodic reload of the signing keys. The keys loaded
+// last stay in use.
+func StopSigning() {
+	if signingStop != nil {
+		close(signingStop)
+		signingStop = nil
+	}
+}
+
+func refreshDeviceKeys(db *sql.DB, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := loadDeviceKeys(db); err != nil {
+				slog.Error("Refreshing signing keys failed, keeping the previous keys", "error", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// loadDeviceKeys reads the secrets from the key file and the key table. A key
+// in the table overrides the one from the file. The previous keys are kept if
+// a source cannot be read.
+func loadDeviceKeys(db *sql.DB) error {
+	keys := make(map[string][]byte)
+	if signing.keyFile != "" {
+		data, err := os.ReadFile(signing.keyFile)
+		if err != nil {
+			return fmt.Errorf("reading key file: %w", err)
+		}
+		var fileKeys map[string]string
+		if err := yaml.Unmarshal(data, &fileKeys); err != nil {
+			return fmt.Errorf("decoding key file %s: %w", signing.keyFile, err)
+		}
+		for id, secret := range fileKeys {
+			keys[id] = []byte(secret)
+		}
+	}
+	if signing.keyTable != "" {
+		rows, err := db.Query(fmt.Sprintf("SELECT devID, secret FROM %s", signing.keyTable))
+		if err != nil {
+			return fmt.Errorf("loading keys from %s: %w", signing.keyTable, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, secret string
+			if err := rows.Scan(&id, &secret); err != nil {
+				return fmt.Errorf("scanning %s: %w", signing.keyTable, err)
+			}
+			keys[id] = []byte(secret)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("loading keys from %s: %w", signing.keyTable, err)
+		}
+	}
+
+	keysMu.Lock()
+	deviceKeys = keys
+	keysMu.Unlock()
+	slog.Info("Loaded signing keys", "devices", len(keys))
+	return nil
+}
+
+func deviceKey(deviceID string) ([]byte, bool) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	key, ok := deviceKeys[deviceID]
+	return key, ok
+}
+
+// verifyPayload checks the signature of a message and returns the payload to
+// process, with the envelope removed. When ok is false the message has been
+// written to the rejection log and must not be processed.
+func verifyPayload(topic, deviceID string, payload []byte) (data []byte, ok bool) {
+	if !signing.enabled {
+		return payload, true
+	}
+
+	var env signedEnvelope
+	signed := strings.HasPrefix(strings.TrimSpace(string(payload)), "{") &&
+		json.Unmarshal(payload, &env) == nil && env.HMAC != "" && len(env.Data) > 0
+
+	key, hasKey := deviceKey(deviceID)
+	reason := ""
+	switch {
+	case !hasKey && signing.required:
+		reason = "no signing key for device"
+	case !hasKey && signed:
+		slog.Warn("Signed message from device without a key, accepting it unverified", "deviceID", deviceID, "topic", topic)
+		return env.Data, true
+	case !hasKey:
+		return payload, true
+	case !signed:
+		reason = "missing signature"
+	default:
+		sig, err := hex.DecodeString(env.HMAC)
+		mac := hmac.New(sha256.New, key)
+		mac.Write(env.Data)
+		if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+			reason = "invalid signature"
+		}
+	}
+	if reason != "" {
+		slog.Warn("Rejected message", "deviceID", deviceID, "topic", topic, "reason", reason)
+		stats.count("rejected")
+		recordQuarantine(signing.rejectionLog, topic, deviceID, actionReject, reason, payload)
+		return nil, false
+	}
+	return env.Data, true
+}
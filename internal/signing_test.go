@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sign(secret, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyPayload(t *testing.T) {
+	data := `{"ts":1700000000,"values":{"sensor1":1.5}}`
+	signed := `{"data":` + data + `,"hmac":"` + sign("k1", data) + `"}`
+	forged := `{"data":` + data + `,"hmac":"` + sign("other", data) + `"}`
+	tests := []struct {
+		name     string
+		required bool
+		deviceID string
+		payload  string
+		want     string
+		ok       bool
+	}{
+		{"valid signature", false, "dev1", signed, data, true},
+		{"wrong key", false, "dev1", forged, "", false},
+		{"bad hex", false, "dev1", `{"data":` + data + `,"hmac":"zz"}`, "", false},
+		{"unsigned from device with key", false, "dev1", data, "", false},
+		{"unsigned from device without key", false, "dev2", data, data, true},
+		{"signed from device without key", false, "dev2", signed, data, true},
+		{"device without key when required", true, "dev2", data, "", false},
+		{"data changed after signing", false, "dev1", `{"data":{"ts":1700000000,"values":{"sensor1":9}},"hmac":"` + sign("k1", data) + `"}`, "", false},
+	}
+	defer func(p signingPolicy, k map[string][]byte) { signing, deviceKeys = p, k }(signing, deviceKeys)
+	deviceKeys = map[string][]byte{"dev1": []byte("k1")}
+	for _, tt := range tests {
+		signing = signingPolicy{enabled: true, required: tt.required, rejectionLog: filepath.Join(t.TempDir(), "rejected.log")}
+		got, ok := verifyPayload("v1/devices/"+tt.deviceID+"/telemetry", tt.deviceID, []byte(tt.payload))
+		if ok != tt.ok || string(got) != tt.want {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+		if _, err := os.Stat(signing.rejectionLog); (err == nil) == tt.ok {
+			t.Errorf("%s: rejection log written = %v, want %v", tt.name, err == nil, !tt.ok)
+		}
+	}
+}
+
+func TestSetupSigningKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "keys.yaml")
+	if err := os.WriteFile(valid, []byte("dev1: k1\ndev2: k2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("- not a map\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		keyFile string
+		wantErr bool
+	}{
+		{valid, false},
+		{filepath.Join(dir, "missing.yaml"), true},
+		{invalid, true},
+	}
+	defer func(p signingPolicy, k map[string][]byte) { signing, deviceKeys = p, k }(signing, deviceKeys)
+	defer StopSigning()
+	for _, tt := range tests {
+		deviceKeys = map[string][]byte{}
+		var config Config
+		config.Signing.Enabled = true
+		config.Signing.KeyFile = tt.keyFile
+		err := SetupSigning(config, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetupSigning with %s: error %v, want error %v", filepath.Base(tt.keyFile), err, tt.wantErr)
+		}
+		if !tt.wantErr && len(deviceKeys) != 2 {
+			t.Errorf("SetupSigning with %s: %d keys, want 2", filepath.Base(tt.keyFile), len(deviceKeys))
+		}
+	}
+}
+
+func TestStopSigning(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeys := func(keys string) {
+		if err := os.WriteFile(keyFile, []byte(keys), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForKey := func(id string) bool {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if _, ok := deviceKey(id); ok {
+				return true
+			}
+		}
+		return false
+	}
+	defer func(p signingPolicy, k map[string][]byte) { signing, deviceKeys = p, k }(signing, deviceKeys)
+	writeKeys("dev1: k1\n")
+	var config Config
+	config.Signing.Enabled = true
+	config.Signing.KeyFile = keyFile
+	config.Signing.RefreshInterval = 10 * time.Millisecond
+	if err := SetupSigning(config, nil); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys("dev2: k2\n")
+	if !waitForKey("dev2") {
+		t.Fatal("keys were not reloaded")
+	}
+	StopSigning()
+	// A reload that was already running may still finish
+	time.Sleep(20 * time.Millisecond)
+	writeKeys("dev3: k3\n")
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := deviceKey("dev3"); ok {
+		t.Error("keys were reloaded after StopSigning")
+	}
+	StopSigning()
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceStats is what the converter has seen from one device since start.
+type DeviceStats struct {
+	DeviceID   string    `json:"device_id"`
+	LastSeen   time.Time `json:"last_seen"`
+	LastTopic  string    `json:"last_topic"`
+	Telemetry  int64     `json:"telemetry"`
+	Attributes int64     `json:"attributes"`
+	Errors     int64     `json:"errors"`
+	// RecentErrors holds the last few failed or refused entries, newest last
+	RecentErrors []DeviceError `json:"recent_errors,omitempty"`
+}
+
+type DeviceError struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	Results string    `json:"results"`
+}
+
+const recentErrors = 10
+
+// maxDevices bounds the devices tracked; when it is reached the one seen
+// longest ago is dropped.
+const maxDevices = 10000
+
+// runStats holds the in-memory counters reported by /status. They start at
+// zero with the process.
+type runStats struct {
+	mu       sync.Mutex
+	started  time.Time
+	counters map[string]int64
+	devices  map[string]*DeviceStats
+}
+
+var stats = &runStats{
+	started:  time.Now(),
+	counters: make(map[string]int64),
+	devices:  make(map[string]*DeviceStats),
+}
+
+// count adds one to a named outcome counter: inserted, rejected or
+// quarantined.
+func (s *runStats) count(name string) {
+	s.mu.Lock()
+	s.counters[name]++
+	s.mu.Unlock()
+	metricResults.inc(name)
+}
+
+// message counts a message as it arrives, before any check.
+func (s *runStats) message(topic string) {
+	kind := topicKind(topic)
+	metricMessages.inc(kind)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters["received"]++
+	s.counters[kind]++
+}
+
+// deviceMessage records a message of a device once it has passed
+// authorization and signature verification, so that made-up device IDs do
+// not show up in /status or the online metrics.
+func (s *runStats) deviceMessage(topic, deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.device(deviceID)
+	d.LastSeen = localNow()
+	d.LastTopic = topic
+	if topicKind(topic) == "telemetry" {
+		d.Telemetry++
+	} else {
+		d.Attributes++
+	}
+}
+
+// entryWritten counts device log entries that carry an error.
+func (s *runStats) entryWritten(entry LogEntry) {
+	if !entry.HasError() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters["log_errors"]++
+	// Only devices that got past authorization are tracked
+	d, ok := s.devices[entry.DeviceID]
+	if !ok {
+		return
+	}
+	d.Errors++
+	d.RecentErrors = append(d.RecentErrors, DeviceError{entry.Time, entry.Topic, strings.Join(entry.results(), "; ")})
+	if len(d.RecentErrors) > recentErrors {
+		d.RecentErrors = d.RecentErrors[len(d.RecentErrors)-recentErrors:]
+	}
+}
+
+// device returns the stats of a device. Must be called with s.mu held.
+func (s *runStats) device(deviceID string) *DeviceStats {
+	d, ok := s.devices[deviceID]
+	if !ok {
+		if len(s.devices) >= maxDevices {
+			var idle *DeviceStats
+			for _, e := range s.devices {
+				if idle == nil || e.LastSeen.Before(idle.LastSeen) {
+					idle = e
+				}
+			}
+			delete(s.devices, idle.DeviceID)
+		}
+		d = &DeviceStats{DeviceID: deviceID}
+		s.devices[deviceID] = d
+	}
+	return d
+}
+
+func (s *runStats) snapshot() (map[string]int64, []DeviceStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := make(map[string]int64, len(s.counters))
+	for k, v := range s.counters {
+		counters[k] = v
+	}
+	devices := make([]DeviceStats, 0, len(s.devices))
+	for _, d := range s.devices {
+		c := *d
+		c.RecentErrors = append([]DeviceError(nil), d.RecentErrors...)
+		devices = append(devices, c)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return counters, devices
+}
+
+func topicKind(topic string) string {
+	switch {
+	case strings.Contains(topic, "telemetry"):
+		return "telemetry"
+	case strings.Contains(topic, "attributes"):
+		return "attributes"
+	}
+	return "other"
+}
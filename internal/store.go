@@ -0,0 +1,428 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The store holds every statement on sensor_data, rdas_dev and alert, for
+// ingestion as well as the HTTP API. All values are passed as parameters.
+// mysqlStore and postgresStore implement it for the sql.driver in config.yaml.
+
+type Store interface {
+	InsertReading(r Reading, ignoreDuplicate bool) (bool, error)
+	UpdateDevice(deviceID string, state DeviceState) (int64, error)
+	LatestData(deviceID string) (string, bool, error)
+	DeviceExists(deviceID string) (bool, error)
+	CreateDevice(deviceID string, tmpl DeviceTemplate) error
+	Totalizers(deviceID string) (float64, float64, error)
+	UpdateTotals(deviceID string, t DeviceTotals) error
+	InsertAlert(a Alert) error
+	Devices(deviceID string) ([]Device, error)
+	LatestReading(deviceID string) (Reading, bool, error)
+	History(deviceID string, from, to time.Time, limit, offset int) ([]Reading, error)
+	Aggregate(deviceID string, from, to time.Time, interval time.Duration) ([]Aggregate, error)
+	Alerts(from, to time.Time, source, project string) ([]Alert, error)
+}
+
+// Reading is one row of sensor_data.
+type Reading struct {
+	DeviceID string     `json:"device_id"`
+	Time     time.Time  `json:"time"`
+	Sensors  [4]float64 `json:"sensors"`
+	UnBox    string     `json:"unbox"`
+}
+
+// DeviceState holds the rdas_dev values written for a message. Nil and empty
+// fields are left unchanged.
+type DeviceState struct {
+	// LatestData also sets status to NOW(). The update is applied only if it
+	// is not older than the stored LatestData.
+	LatestData  *time.Time
+	Sensors     *[4]float64
+	UnBox       string
+	MainPower   *float64
+	GSMSignal   *int
+	SampleTime  *int
+	SendingRate *int
+}
+
+// Alert is a row of the alert table. A zero EventTime is stored as NOW().
+type Alert struct {
+	EventTime   time.Time
+	Source      string
+	Priority    int
+	Description string
+	Project     string
+	Note        string
+}
+
+// Device is the realtime state of a device in rdas_dev.
+type Device struct {
+	DeviceID   string    `json:"device_id"`
+	Name       string    `json:"name"`
+	Project    string    `json:"project"`
+	LatestData string    `json:"latest_data"`
+	Sensors    [4]string `json:"sensors"`
+	UnBox      string    `json:"unbox"`
+	MainPower  float64   `json:"main_power"`
+	GSMSignal  int       `json:"gsm_signal"`
+}
+
+// DeviceTotals are the rdas_dev columns maintained by the totalizer job.
+type DeviceTotals struct {
+	Totalizer1, Totalizer2       float64
+	DailyLatched, MonthlyLatched string
+	MonthlyTotal                 int64
+}
+
+// Aggregate summarizes the readings of one interval.
+type Aggregate struct {
+	Start time.Time  `json:"start"`
+	Count int64      `json:"count"`
+	Min   [4]float64 `json:"min"`
+	Max   [4]float64 `json:"max"`
+	Avg   [4]float64 `json:"avg"`
+}
+
+const sqlDateTime = "2006-01-02 15:04:05"
+
+type mysqlStore struct {
+	db        *sql.DB
+	rollups   bool      // maintain and read the rollup tables
+	liveSince time.Time // since when this process maintains them
+}
+
+var store Store
+
+// InsertReading adds a row to sensor_data. With ignoreDuplicate a reading
+// that violates the unique index is skipped and reported as not inserted.
+func (s *mysqlStore) InsertReading(r Reading, ignoreDuplicate bool) (bool, error) {
+	verb := "INSERT INTO"
+	if ignoreDuplicate {
+		verb = "INSERT IGNORE INTO"
+	}
+	query := verb + " sensor_data (deviceID, status, sensor1, sensor2, sensor3, sensor4, sensor5, sensor6, sensor7, sensor8, SensorPowerStatus, GSMSignal, `Current_timestamp`, date_time, UnBox) VALUES (?, 'active', ?, ?, ?, ?, 0, 0, 0, 0, 'ON', 0, NOW(), ?, ?)"
+	args := []interface{}{r.DeviceID, r.Sensors[0], r.Sensors[1], r.Sensors[2], r.Sensors[3], r.Time.Format(sqlDateTime), r.UnBox}
+	if s.rollups {
+		inserted, err := s.insertWithRollups(r, query, args)
+		if isLockConflict(err) {
+			// A rollup rebuild held the lock for too long; try once more
+			inserted, err = s.insertWithRollups(r, query, args)
+		}
+		return inserted, err
+	}
+	res, err := execSQL(s.db, "insert_sensor_data", r.DeviceID, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// UpdateDevice writes state to the device's rdas_dev row and returns the
+// number of rows matched: 0 if the device has no row or the reading is
+// older than LatestData.
+func (s *mysqlStore) UpdateDevice(deviceID string, state DeviceState) (int64, error) {
+	operation, query, args := updateDeviceQuery(deviceID, state)
+	res, err := execSQL(s.db, operation, deviceID, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// updateDeviceQuery builds the UPDATE of UpdateDevice with ? placeholders.
+func updateDeviceQuery(deviceID string, state DeviceState) (string, string, []interface{}) {
+	var set []string
+	var args []interface{}
+	add := func(column string, value interface{}) {
+		set = append(set, column+" = ?")
+		args = append(args, value)
+	}
+	operation := "update_attributes"
+	if state.LatestData != nil {
+		operation = "update_rdas_dev"
+		set = append(set, "status = NOW()")
+		add("LatestData", state.LatestData.Format(sqlDateTime))
+	}
+	if state.Sensors != nil {
+		for i, v := range state.Sensors {
+			// Current_ssN are VARCHAR columns, keep the format they always had
+			add(fmt.Sprintf("Current_ss%d", i+1), strconv.FormatFloat(v, 'f', 6, 64))
+		}
+	}
+	if state.MainPower != nil {
+		add("MainPower", *state.MainPower)
+	}
+	if state.GSMSignal != nil {
+		add("GSMSignal", *state.GSMSignal)
+	}
+	if state.SampleTime != nil {
+		add("sample_time", *state.SampleTime)
+	}
+	if state.SendingRate != nil {
+		add("SendingRate", *state.SendingRate)
+	}
+	if state.UnBox != "" {
+		add("UnBox", state.UnBox)
+	}
+	set = append(set, "Type = 'MQTT'")
+
+	query := "UPDATE rdas_dev SET " + strings.Join(set, ", ") + " WHERE devID = ?"
+	args = append(args, deviceID)
+	if state.LatestData != nil {
+		query += " AND (LatestData IS NULL OR LatestData <= ?)"
+		args = append(args, state.LatestData.Format(sqlDateTime))
+	}
+	return operation, query, args
+}
+
+// LatestData returns the LatestData of a device and whether it has a
+// rdas_dev row.
+func (s *mysqlStore) LatestData(deviceID string) (string, bool, error) {
+	var latest sql.NullString
+	err := s.db.QueryRow("SELECT LatestData FROM rdas_dev WHERE devID = ?", deviceID).Scan(&latest)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return latest.String, err == nil, err
+}
+
+func (s *mysqlStore) DeviceExists(deviceID string) (bool, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM rdas_dev WHERE devID = ?", deviceID).Scan(&count)
+	return count > 0, err
+}
+
+// CreateDevice inserts a rdas_dev row from the unknown device template.
+func (s *mysqlStore) CreateDevice(deviceID string, tmpl DeviceTemplate) error {
+	columns, args := deviceTemplateValues(deviceID, tmpl)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := fmt.Sprintf("INSERT INTO rdas_dev (`%s`) VALUES (%s)", strings.Join(columns, "`, `"), placeholders)
+	_, err := execSQL(s.db, "create_device", deviceID, query, args...)
+	return err
+}
+
+// deviceTemplateValues returns the rdas_dev columns and values of a new
+// device, the template's extra columns sorted by name.
+func deviceTemplateValues(deviceID string, tmpl DeviceTemplate) ([]string, []interface{}) {
+	columns := []string{"userID", "devID", "Name", "Name1", "Project", "Type"}
+	args := []interface{}{tmpl.UserID, deviceID, deviceID, deviceID, tmpl.Project, tmpl.Type}
+	extra := make([]string, 0, len(tmpl.Columns))
+	for col := range tmpl.Columns {
+		extra = append(extra, col)
+	}
+	sort.Strings(extra)
+	for _, col := range extra {
+		columns = append(columns, col)
+		args = append(args, tmpl.Columns[col])
+	}
+	return columns, args
+}
+
+// Totalizers returns Totalizer1 and Totalizer2 of a device.
+func (s *mysqlStore) Totalizers(deviceID string) (float64, float64, error) {
+	var t1, t2 float64
+	err := s.db.QueryRow("SELECT Totalizer1, Totalizer2 FROM rdas_dev WHERE devID = ?", deviceID).Scan(&t1, &t2)
+	return t1, t2, err
+}
+
+// UpdateTotals writes the totals of a device. Empty latched values are left
+// unchanged.
+func (s *mysqlStore) UpdateTotals(deviceID string, t DeviceTotals) error {
+	_, err := execSQL(s.db, "update_totals", deviceID, "UPDATE rdas_dev SET Totalizer1 = ?, Totalizer2 = ?, DailyLatched = COALESCE(NULLIF(?, ''), DailyLatched), MonthlyLatched = COALESCE(NULLIF(?, ''), MonthlyLatched), MonthlyTotal = ? WHERE devID = ?",
+		t.Totalizer1, t.Totalizer2, t.DailyLatched, t.MonthlyLatched, t.MonthlyTotal, deviceID)
+	return err
+}
+
+func (s *mysqlStore) InsertAlert(a Alert) error {
+	eventTime := "NOW()"
+	args := []interface{}{}
+	if !a.EventTime.IsZero() {
+		eventTime = "?"
+		args = append(args, a.EventTime.Format(sqlDateTime))
+	}
+	args = append(args, a.Source, a.Priority, a.Description, a.Project, a.Note)
+	_, err := execSQL(s.db, "insert_alert", a.Source, "INSERT INTO alert (EventTime, InsertTime, Source, Priority, Description, AlertType, Project, Type, Status, Note) VALUES ("+eventTime+", NOW(), ?, ?, ?, 'Device', ?, 'Alert', 'V', ?)", args...)
+	return err
+}
+
+// Devices returns the rdas_dev rows ordered by devID, or only deviceID when
+// it is not empty.
+func (s *mysqlStore) Devices(deviceID string) ([]Device, error) {
+	query := "SELECT devID, Name, Project, LatestData, Current_ss1, Current_ss2, Current_ss3, Current_ss4, UnBox, MainPower, GSMSignal FROM rdas_dev"
+	var args []interface{}
+	if deviceID != "" {
+		query += " WHERE devID = ?"
+		args = append(args, deviceID)
+	}
+	rows, err := s.db.Query(query+" ORDER BY devID", args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDevices(rows)
+}
+
+func scanDevices(rows *sql.Rows) ([]Device, error) {
+	defer rows.Close()
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		var latest, unBox sql.NullString
+		var sensors [4]sql.NullString
+		if err := rows.Scan(&d.DeviceID, &d.Name, &d.Project, &latest, &sensors[0], &sensors[1], &sensors[2], &sensors[3], &unBox, &d.MainPower, &d.GSMSignal); err != nil {
+			return nil, err
+		}
+		d.LatestData = latest.String
+		for i, v := range sensors {
+			d.Sensors[i] = v.String
+		}
+		d.UnBox = unBox.String
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// LatestReading returns the newest sensor_data row of a device.
+func (s *mysqlStore) LatestReading(deviceID string) (Reading, bool, error) {
+	readings, err := s.queryReadings("SELECT deviceID, date_time, sensor1, sensor2, sensor3, sensor4, UnBox FROM sensor_data WHERE deviceID = ? ORDER BY date_time DESC LIMIT 1", deviceID)
+	if err != nil || len(readings) == 0 {
+		return Reading{}, false, err
+	}
+	return readings[0], true, nil
+}
+
+// History returns the readings of a device with from <= date_time < to,
+// oldest first, skipping offset rows and returning at most limit.
+func (s *mysqlStore) History(deviceID string, from, to time.Time, limit, offset int) ([]Reading, error) {
+	return s.queryReadings("SELECT deviceID, date_time, sensor1, sensor2, sensor3, sensor4, UnBox FROM sensor_data WHERE deviceID = ? AND date_time >= ? AND date_time < ? ORDER BY date_time, Idx LIMIT ? OFFSET ?",
+		deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime), limit, offset)
+}
+
+func (s *mysqlStore) queryReadings(query string, args ...interface{}) ([]Reading, error) {
+	return queryReadings(s.db, query, args...)
+}
+
+// queryReadings runs a query for deviceID, date_time as text, sensor1..4 and
+// UnBox.
+func queryReadings(db *sql.DB, query string, args ...interface{}) ([]Reading, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Reading
+	for rows.Next() {
+		var r Reading
+		var dt string
+		var sensors [4]sql.NullFloat64
+		if err := rows.Scan(&r.DeviceID, &dt, &sensors[0], &sensors[1], &sensors[2], &sensors[3], &r.UnBox); err != nil {
+			return nil, err
+		}
+		if r.Time, err = time.ParseInLocation(sqlDateTime, dt, location); err != nil {
+			return nil, err
+		}
+		for i, v := range sensors {
+			r.Sensors[i] = v.Float64
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Aggregate returns min, max and average of every channel per interval for
+// the readings with from <= date_time < to. Intervals are aligned in the
+// configured timezone, so daily intervals start at local midnight. Whole hours
+// and days are read from the rollup tables when they are enabled.
+func (s *mysqlStore) Aggregate(deviceID string, from, to time.Time, interval time.Duration) ([]Aggregate, error) {
+	secs := int64(interval / time.Second)
+	if secs <= 0 {
+		return nil, fmt.Errorf("interval must be at least 1s")
+	}
+	// Buckets count seconds of local wall clock, not UNIX_TIMESTAMP, so they
+	// stay aligned to local midnight across DST changes
+	table, timeColumn, columns := s.aggregateSource(deviceID, from, to, interval)
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT FLOOR(TIMESTAMPDIFF(SECOND, '1970-01-01 00:00:00', %[2]s) / ?) AS b, %[3]s
+		FROM %[1]s WHERE deviceID = ? AND %[2]s >= ? AND %[2]s < ?
+		GROUP BY b ORDER BY b`, table, timeColumn, strings.Join(columns, ", ")),
+		secs, deviceID, from.Format(sqlDateTime), to.Format(sqlDateTime))
+	if err != nil {
+		return nil, err
+	}
+	return scanAggregates(rows, secs)
+}
+
+// scanAggregates reads rows of bucket number, count and min, max and average
+// of each channel. Bucket b starts at the local wall clock b*secs seconds
+// after 1970-01-01 00:00:00.
+func scanAggregates(rows *sql.Rows, secs int64) ([]Aggregate, error) {
+	defer rows.Close()
+	var out []Aggregate
+	for rows.Next() {
+		var a Aggregate
+		var bucket int64
+		var v [12]sql.NullFloat64
+		if err := rows.Scan(&bucket, &a.Count, &v[0], &v[1], &v[2], &v[3], &v[4], &v[5], &v[6], &v[7], &v[8], &v[9], &v[10], &v[11]); err != nil {
+			return nil, err
+		}
+		a.Start = wallClock(bucket * secs)
+		for i := 0; i < 4; i++ {
+			a.Min[i], a.Max[i], a.Avg[i] = v[i].Float64, v[4+i].Float64, v[8+i].Float64
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// wallClock returns the local time whose wall clock is secs seconds after
+// 1970-01-01 00:00:00.
+func wallClock(secs int64) time.Time {
+	w := time.Unix(secs, 0).UTC()
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, location)
+}
+
+// Alerts returns the alerts with from <= EventTime < to, oldest first. Empty
+// source and project match every alert.
+func (s *mysqlStore) Alerts(from, to time.Time, source, project string) ([]Alert, error) {
+	query := "SELECT EventTime, Source, Priority, Description, Project, Note FROM alert WHERE EventTime >= ? AND EventTime < ?"
+	args := []interface{}{from.Format(sqlDateTime), to.Format(sqlDateTime)}
+	if source != "" {
+		query += " AND Source = ?"
+		args = append(args, source)
+	}
+	if project != "" {
+		query += " AND Project = ?"
+		args = append(args, project)
+	}
+	rows, err := s.db.Query(query+" ORDER BY EventTime", args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAlerts(rows)
+}
+
+func scanAlerts(rows *sql.Rows) ([]Alert, error) {
+	defer rows.Close()
+	var out []Alert
+	for rows.Next() {
+		var a Alert
+		var eventTime string
+		var description, project, note sql.NullString
+		if err := rows.Scan(&eventTime, &a.Source, &a.Priority, &description, &project, &note); err != nil {
+			return nil, err
+		}
+		t, err := time.ParseInLocation(sqlDateTime, eventTime, location)
+		if err != nil {
+			return nil, err
+		}
+		a.EventTime = t
+		a.Description, a.Project, a.Note = description.String, project.String, note.String
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
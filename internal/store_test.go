@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWallClock(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func(l *time.Location) { location = l }(location)
+	location = ny
+	day := int64(24 * time.Hour / time.Second)
+	tests := []struct {
+		secs int64
+		want string
+	}{
+		{0, "1970-01-01 00:00:00 -0500"},
+		// Days on both sides of the 2024 DST changes start at local midnight
+		{19792 * day, "2024-03-10 00:00:00 -0500"},
+		{19793 * day, "2024-03-11 00:00:00 -0400"},
+		{20030 * day, "2024-11-03 00:00:00 -0400"},
+		{20031 * day, "2024-11-04 00:00:00 -0500"},
+		{19793*day + 3600*13 + 90, "2024-03-11 13:01:30 -0400"},
+	}
+	for _, tt := range tests {
+		if got := wallClock(tt.secs).Format("2006-01-02 15:04:05 -0700"); got != tt.want {
+			t.Errorf("wallClock(%d) = %s, want %s", tt.secs, got, tt.want)
+		}
+	}
+}
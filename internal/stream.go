@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// StreamEvent is a processed reading or an alert as sent to the live stream
+// subscribers.
+type StreamEvent struct {
+	Type        string      `json:"type"` // reading or alert
+	DeviceID    string      `json:"device_id"`
+	Project     string      `json:"project,omitempty"`
+	Topic       string      `json:"topic,omitempty"`
+	ReadingTime string      `json:"reading_time"`
+	Sensors     *[4]float64 `json:"sensors,omitempty"`
+	UnBox       string      `json:"unbox,omitempty"`
+	Alert       string      `json:"alert,omitempty"`
+}
+
+type streamSubscriber struct {
+	devices  map[string]bool
+	projects map[string]bool
+	events   chan []byte
+}
+
+func (s *streamSubscriber) wants(e StreamEvent) bool {
+	if len(s.devices) > 0 && !s.devices[e.DeviceID] {
+		return false
+	}
+	if len(s.projects) > 0 && !s.projects[e.Project] {
+		return false
+	}
+	return true
+}
+
+// streamHub fans events out to subscribers. Publishing never blocks: a
+// subscriber that does not keep up loses events.
+type streamHub struct {
+	mu          sync.Mutex
+	enabled     bool
+	origins     []string
+	subscribers map[*streamSubscriber]bool
+}
+
+var hub = &streamHub{subscribers: make(map[*streamSubscriber]bool)}
+
+var metricStreamDropped = newMetric("counter", "converter_stream_dropped_total",
+	"Live stream events dropped because a subscriber was too slow.", nil)
+
+func (h *streamHub) publish(e StreamEvent) {
+	h.mu.Lock()
+	active := h.enabled && len(h.subscribers) > 0
+	h.mu.Unlock()
+	if !active {
+		return
+	}
+	// publish runs in the MQTT callback, so the project comes from the
+	// cached registry only and never costs a query
+	if e.Project == "" {
+		e.Project = registry.project(e.DeviceID)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Encoding stream event failed", "deviceID", e.DeviceID, "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.events <- data:
+		default:
+			metricStreamDropped.inc()
+		}
+	}
+}
+
+func (h *streamHub) subscribe(r *http.Request) *streamSubscriber {
+	s := &streamSubscriber{
+		devices:  listParam(r, "device"),
+		projects: listParam(r, "project"),
+		events:   make(chan []byte, 64),
+	}
+	h.mu.Lock()
+	h.subscribers[s] = true
+	n := len(h.subscribers)
+	h.mu.Unlock()
+	slog.Info("Stream subscriber connected", "remote", r.RemoteAddr, "subscribers", n)
+	return s
+}
+
+func (h *streamHub) unsubscribe(s *streamSubscriber, r *http.Request) {
+	h.mu.Lock()
+	delete(h.subscribers, s)
+	n := len(h.subscribers)
+	h.mu.Unlock()
+	slog.Info("Stream subscriber disconnected", "remote", r.RemoteAddr, "subscribers", n)
+}
+
+// listParam reads a filter such as ?device=T1,T2&device=T3.
+func listParam(r *http.Request, name string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range r.URL.Query()[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				set[item] = true
+			}
+		}
+	}
+	return set
+}
+
+func registerStream(mux *http.ServeMux, origins []string) {
+	hub.mu.Lock()
+	hub.enabled = true
+	hub.origins = origins
+	hub.mu.Unlock()
+
+	mux.HandleFunc("GET /stream/events", serveSSE)
+	mux.HandleFunc("GET /stream/ws", serveWebSocket)
+}
+
+// serveSSE streams events as Server-Sent Events.
+func serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	s := hub.subscribe(r)
+	defer hub.unsubscribe(s, r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-s.events:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// checkOrigin lets a browser open the WebSocket only from a page on the same
+// host or on one of http.allowed_origins, so that other sites cannot read the
+// stream. Clients that send no Origin are not browsers and may connect.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, allowed := range hub.origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	slog.Warn("WebSocket origin not allowed", "remote", r.RemoteAddr, "origin", origin)
+	return false
+}
+
+// serveWebSocket streams events as one JSON text message each. Messages from
+// the client are ignored.
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+	s := hub.subscribe(r)
+	defer hub.unsubscribe(s, r)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case data := <-s.events:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
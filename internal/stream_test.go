@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://converter.local:8080", true},
+		{"http://CONVERTER.local:8080", true},
+		{"https://scada.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://converter.local:9090", false},
+		{"://bad", false},
+	}
+	defer func(o []string) { hub.origins = o }(hub.origins)
+	hub.origins = []string{"https://scada.example.com/"}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://converter.local:8080/stream/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkOrigin(r); got != tt.want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestPublishProject(t *testing.T) {
+	defer func(r *deviceRegistry) { registry = r }(registry)
+	defer func(e bool, s map[*streamSubscriber]bool) { hub.enabled, hub.subscribers = e, s }(hub.enabled, hub.subscribers)
+	registry = &deviceRegistry{devices: map[string]string{"DEV1": "SOVIGAZ"}, missing: make(map[string]time.Time)}
+	sub := &streamSubscriber{projects: map[string]bool{"SOVIGAZ": true}, events: make(chan []byte, 4)}
+	hub.enabled, hub.subscribers = true, map[*streamSubscriber]bool{sub: true}
+
+	// DEV2 is not cached; without a database it must be skipped, not looked up
+	hub.publish(StreamEvent{Type: "reading", DeviceID: "DEV2"})
+	hub.publish(StreamEvent{Type: "reading", DeviceID: "DEV1"})
+	if n := len(sub.events); n != 1 {
+		t.Fatalf("events = %d, want 1", n)
+	}
+	if got := string(<-sub.events); !strings.Contains(got, `"device_id":"DEV1","project":"SOVIGAZ"`) {
+		t.Errorf("event = %s, want DEV1 with project SOVIGAZ", got)
+	}
+}
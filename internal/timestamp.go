@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Anything below this is too small to be a millisecond epoch of a device that
+// has a working clock (1e11 ms is March 1973), so it is read as seconds.
+const secondsEpochLimit = 1e11
+
+type timestampPolicy struct {
+	unit          string
+	maxPast       time.Duration
+	maxFuture     time.Duration
+	substituteBad bool
+	driftWarn     time.Duration
+}
+
+var tsPolicy = timestampPolicy{
+	unit:      "auto",
+	maxPast:   30 * 24 * time.Hour,
+	maxFuture: 10 * time.Minute,
+	driftWarn: 2 * time.Minute,
+}
+
+// ClockDrift is the estimated offset of a device clock against the server,
+// positive when the device runs ahead.
+type ClockDrift struct {
+	Offset  time.Duration
+	Samples int
+	Updated time.Time
+	warned  bool
+}
+
+var (
+	driftMu sync.Mutex
+	drifts  = make(map[string]*ClockDrift)
+)
+
+func SetupTimestamps(config Config) {
+	c := config.Timestamp
+	if c.Unit != "" {
+		tsPolicy.unit = c.Unit
+	}
+	if c.MaxPast > 0 {
+		tsPolicy.maxPast = c.MaxPast
+	}
+	if c.MaxFuture > 0 {
+		tsPolicy.maxFuture = c.MaxFuture
+	}
+	if c.DriftWarn > 0 {
+		tsPolicy.driftWarn = c.DriftWarn
+	}
+	tsPolicy.substituteBad = c.SubstituteBad
+	slog.Info("Timestamp policy", "unit", tsPolicy.unit, "maxPast", tsPolicy.maxPast, "maxFuture", tsPolicy.maxFuture, "substituteBad", tsPolicy.substituteBad)
+}
+
+// deviceTime converts a raw ts value according to the configured unit.
+func deviceTime(ts float64) time.Time {
+	switch {
+	case tsPolicy.unit == "s":
+		return time.Unix(int64(ts), 0).In(location)
+	case tsPolicy.unit == "ms":
+		return time.UnixMilli(int64(ts)).In(location)
+	case ts < secondsEpochLimit:
+		return time.Unix(int64(ts), 0).In(location)
+	}
+	return time.UnixMilli(int64(ts)).In(location)
+}
+
+// readingTime returns the time to store for a reading. note is non-empty when
+// the device time was outside the acceptance window; ok is false when the
+// reading has to be dropped because substitution is disabled.
+func readingTime(ts float64, received time.Time) (dt time.Time, note string, ok bool) {
+	dt = deviceTime(ts)
+	if note = windowNote(dt, received); note == "" {
+		return dt, "", true
+	}
+	if tsPolicy.substituteBad {
+		return received, note + ", replaced with server time", true
+	}
+	return dt, note, false
+}
+
+// windowNote describes why dt is outside the acceptance window around
+// received, or returns "" if it is inside.
+func windowNote(dt, received time.Time) string {
+	switch {
+	case dt.Before(received.Add(-tsPolicy.maxPast)):
+		return fmt.Sprintf("ts %s is more than %s in the past", dt.Format("2006-01-02 15:04:05"), tsPolicy.maxPast)
+	case dt.After(received.Add(tsPolicy.maxFuture)):
+		return fmt.Sprintf("ts %s is more than %s in the future", dt.Format("2006-01-02 15:04:05"), tsPolicy.maxFuture)
+	}
+	return ""
+}
+
+// newestTimestamp returns the largest ts in a telemetry payload. Only that
+// frame is used for drift estimation, since older frames may be replays from
+// the device buffer.
+func newestTimestamp(data []map[string]interface{}) float64 {
+	var newest float64
+	for _, item := range data {
+		if ts, ok := item["ts"].(float64); ok && ts > newest {
+			newest = ts
+		}
+	}
+	return newest
+}
+
+// recordDrift updates the exponentially weighted drift estimate of a device.
+// Timestamps outside the acceptance window are rejected or replaced anyway,
+// so they would only skew the estimate of the readings that are kept.
+func recordDrift(deviceID string, ts float64, received time.Time) {
+	dt := deviceTime(ts)
+	if windowNote(dt, received) != "" {
+		return
+	}
+	offset := dt.Sub(received)
+
+	driftMu.Lock()
+	defer driftMu.Unlock()
+	d, ok := drifts[deviceID]
+	if !ok {
+		d = &ClockDrift{Offset: offset}
+		drifts[deviceID] = d
+	} else {
+		d.Offset += (offset - d.Offset) / 5
+	}
+	d.Samples++
+	d.Updated = received
+
+	over := d.Offset > tsPolicy.driftWarn || d.Offset < -tsPolicy.driftWarn
+	if over && !d.warned {
+		slog.Warn("Device clock drifts", "deviceID", deviceID, "drift", d.Offset.Round(time.Second), "samples", d.Samples)
+	} else if !over && d.warned {
+		slog.Info("Device clock back within drift limit", "deviceID", deviceID, "limit", tsPolicy.driftWarn, "drift", d.Offset.Round(time.Second))
+	}
+	d.warned = over
+}
+
+// ClockDrifts returns a snapshot of the drift estimate of every device seen.
+func ClockDrifts() map[string]ClockDrift {
+	driftMu.Lock()
+	defer driftMu.Unlock()
+	out := make(map[string]ClockDrift, len(drifts))
+	for id, d := range drifts {
+		out[id] = *d
+	}
+	return out
+}
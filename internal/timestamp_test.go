@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceTime(t *testing.T) {
+	tests := []struct {
+		unit string
+		ts   float64
+		want int64 // Unix milliseconds
+	}{
+		{"auto", 1700000000, 1700000000000},
+		{"auto", 1700000000123, 1700000000123},
+		{"auto", 99999999999, 99999999999000},
+		{"auto", 100000000000, 100000000000},
+		{"s", 1700000000, 1700000000000},
+		{"ms", 1700000000, 1700000000},
+		{"ms", 1700000000123, 1700000000123},
+	}
+	defer func(p timestampPolicy) { tsPolicy = p }(tsPolicy)
+	for _, tt := range tests {
+		tsPolicy.unit = tt.unit
+		if got := deviceTime(tt.ts).UnixMilli(); got != tt.want {
+			t.Errorf("deviceTime(%.0f) with unit %s = %d ms, want %d ms", tt.ts, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestReadingTime(t *testing.T) {
+	received := time.Unix(1700000000, 0).In(location)
+	tests := []struct {
+		name       string
+		offset     time.Duration
+		substitute bool
+		want       time.Time
+		note       bool
+		ok         bool
+	}{
+		{"now", 0, false, received, false, true},
+		{"inside past window", -29 * 24 * time.Hour, false, received.Add(-29 * 24 * time.Hour), false, true},
+		{"inside future window", 9 * time.Minute, false, received.Add(9 * time.Minute), false, true},
+		{"too old", -31 * 24 * time.Hour, false, received.Add(-31 * 24 * time.Hour), true, false},
+		{"too far ahead", 11 * time.Minute, false, received.Add(11 * time.Minute), true, false},
+		{"too old, substituted", -31 * 24 * time.Hour, true, received, true, true},
+		{"too far ahead, substituted", time.Hour, true, received, true, true},
+	}
+	defer func(p timestampPolicy) { tsPolicy = p }(tsPolicy)
+	for _, tt := range tests {
+		tsPolicy = timestampPolicy{unit: "s", maxPast: 30 * 24 * time.Hour, maxFuture: 10 * time.Minute, substituteBad: tt.substitute}
+		ts := float64(received.Add(tt.offset).Unix())
+		dt, note, ok := readingTime(ts, received)
+		if !dt.Equal(tt.want) || (note != "") != tt.note || ok != tt.ok {
+			t.Errorf("%s: got %s, %q, %v, want %s, note %v, %v", tt.name, dt, note, ok, tt.want, tt.note, tt.ok)
+		}
+	}
+}
+
+func TestRecordDrift(t *testing.T) {
+	received := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		offsets []time.Duration
+		want    time.Duration
+		samples int
+	}{
+		{"single sample", []time.Duration{time.Minute}, time.Minute, 1},
+		{"weighted", []time.Duration{0, 5 * time.Minute}, time.Minute, 2},
+		{"ahead of the window", []time.Duration{time.Minute, 2 * time.Hour}, time.Minute, 1},
+		{"behind the window", []time.Duration{-31 * 24 * time.Hour, -time.Minute}, -time.Minute, 1},
+		{"only outside the window", []time.Duration{24 * time.Hour}, 0, 0},
+	}
+	defer func(p timestampPolicy, d map[string]*ClockDrift) { tsPolicy, drifts = p, d }(tsPolicy, drifts)
+	tsPolicy = timestampPolicy{unit: "s", maxPast: 30 * 24 * time.Hour, maxFuture: 10 * time.Minute, driftWarn: time.Hour}
+	for _, tt := range tests {
+		drifts = make(map[string]*ClockDrift)
+		for _, offset := range tt.offsets {
+			recordDrift("dev1", float64(received.Add(offset).Unix()), received)
+		}
+		d := ClockDrifts()["dev1"]
+		if d.Offset != tt.want || d.Samples != tt.samples {
+			t.Errorf("%s: drift %s over %d samples, want %s over %d", tt.name, d.Offset, d.Samples, tt.want, tt.samples)
+		}
+	}
+}
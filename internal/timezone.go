@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // hosts without /usr/share/zoneinfo can still load the zone
+)
+
+// location is the zone used for every datetime written to the database and
+// for the text of alerts and logs, independent of the host TZ.
+var location = time.Local
+
+func SetupTimezone(config Config) error {
+	if config.Timezone == "" {
+		slog.Info("No timezone configured, using host zone", "timezone", time.Local.String())
+		return nil
+	}
+	loc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %v", config.Timezone, err)
+	}
+	location = loc
+	slog.Info("Using timezone", "timezone", location.String(), "offset", mysqlOffset())
+	return nil
+}
+
+func localNow() time.Time {
+	return time.Now().In(location)
+}
+
+// mysqlZone is the zone name new MySQL sessions use, or "" when the server
+// has no tz tables for it. It is set before the pool is shared.
+var mysqlZone string
+
+// dstConnLifetime bounds how long a MySQL connection keeps the offset it got
+// when it connected, for zones with DST and no tz tables on the server.
+const dstConnLifetime = 15 * time.Minute
+
+// zoneName returns the IANA name of location, looking up the host zone when
+// no timezone is configured, or "" if it is not known.
+func zoneName() string {
+	if location != time.Local {
+		return location.String()
+	}
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		return tz
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// hasDST reports whether the UTC offset of loc changes during this year.
+func hasDST(loc *time.Location) bool {
+	year := time.Now().Year()
+	_, jan := time.Date(year, 1, 1, 0, 0, 0, 0, loc).Zone()
+	_, jul := time.Date(year, 7, 1, 0, 0, 0, 0, loc).Zone()
+	return jan != jul
+}
+
+// mysqlTimeZone is the session time_zone of a MySQL connection being opened.
+func mysqlTimeZone() string {
+	if mysqlZone != "" {
+		return mysqlZone
+	}
+	return mysqlOffset()
+}
+
+// setupMySQLTimeZone makes new sessions use the zone name when the server's
+// tz tables know it, so that NOW() follows DST changes. Otherwise sessions
+// get the offset current when they connect, and in a zone with DST the
+// connection lifetime is cut to dstConnLifetime to pick up a change. It
+// returns the lifetime to use, at most maxLifetime. The pool settings must be
+// applied afterwards.
+func setupMySQLTimeZone(db *sql.DB, maxLifetime time.Duration) time.Duration {
+	if name := zoneName(); name != "" {
+		var converted sql.NullString
+		err := db.QueryRow("SELECT CONVERT_TZ('2000-01-01 00:00:00', '+00:00', ?)", name).Scan(&converted)
+		if err == nil && converted.Valid {
+			mysqlZone = name
+			// Close the idle connection that was opened with the offset
+			db.SetMaxIdleConns(0)
+			slog.Info("MySQL session time_zone set by name", "timezone", name)
+			return maxLifetime
+		}
+	}
+	if !hasDST(location) {
+		return maxLifetime
+	}
+	slog.Warn("MySQL has no tz tables for the zone, so sessions use the UTC offset and NOW() can be off after a DST change until connections are renewed; load them with mysql_tzinfo_to_sql",
+		"timezone", location.String(), "renewal", dstConnLifetime)
+	return min(maxLifetime, dstConnLifetime)
+}
+
+// mysqlOffset returns the current UTC offset of location as "+07:00". MySQL
+// only accepts named zones when its tz tables are loaded, so without them the
+// session time_zone is set to the numeric offset instead.
+func mysqlOffset() string {
+	_, offset := localNow().Zone()
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%02d:%02d", sign, offset/3600, offset%3600/60)
+}
@@ -0,0 +1,485 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+// The totalizer job integrates a sensor channel per device from sensor_data
+// into Totalizer1/2 and latches the daily and monthly amounts at the cut-off
+// times. Its progress is kept in totalizer_state so a restart continues where
+// it stopped; every latched amount is kept in totalizer_latched for billing.
+// Both tables are created by migration 0005.
+
+// TotalizerChannel selects what a totalizer integrates.
+type TotalizerChannel struct {
+	Sensor int `yaml:"sensor"` // 1-4, 0 disables the totalizer
+	// Mode flow integrates a rate over time; counter adds the increase of a
+	// meter reading, counting the new value after a reset.
+	Mode     string        `yaml:"mode"`
+	RateUnit time.Duration `yaml:"rate_unit"` // flow: the rate is per this duration, e.g. 1h for m3/h
+	Scale    float64       `yaml:"scale"`
+	// MaxGap is the longest time between two readings that flow integrates
+	// over; a longer gap is treated as the device being off. A period is
+	// latched only after a reading at or after its cut-off, or once MaxGap
+	// has passed since the last reading.
+	MaxGap time.Duration `yaml:"max_gap"`
+}
+
+// TotalizerConfig is the totalizer section of config.yaml.
+type TotalizerConfig struct {
+	Enabled     bool             `yaml:"enabled"`
+	Interval    time.Duration    `yaml:"interval"`
+	Settle      time.Duration    `yaml:"settle"`
+	DailyCutoff string           `yaml:"daily_cutoff"` // HH:MM
+	MonthlyDay  int              `yaml:"monthly_day"`
+	Projects    []string         `yaml:"projects"`
+	Totalizer1  TotalizerChannel `yaml:"totalizer1"`
+	Totalizer2  TotalizerChannel `yaml:"totalizer2"`
+}
+
+const totalizerBatch = 5000
+
+type totalizerJob struct {
+	states                totalizerStates
+	settings              TotalizerConfig
+	cutoffHour, cutoffMin int
+	projects              map[string]bool
+	channels              [2]TotalizerChannel
+}
+
+type totalizerState struct {
+	DeviceID   string
+	LastTime   *time.Time
+	LastValue  [2]float64
+	Totalizer  [2]float64
+	DayStart   time.Time
+	DayTotal   [2]float64
+	MonthStart time.Time
+	MonthTotal [2]float64
+	latched    []latchedTotal
+	stored     bool // there is a totalizer_state row
+}
+
+// latchedTotal is a row of totalizer_latched.
+type latchedTotal struct {
+	Period     string // day or month
+	Start, End time.Time
+	Total      [2]float64
+	Totalizer  [2]float64
+}
+
+var metricLatched = newMetric("counter", "converter_totalizer_latched_total",
+	"Daily and monthly totals latched, by period.", nil, "period")
+
+// StartTotalizer runs the totalizer job every interval.
+func StartTotalizer(config Config, db *sql.DB) {
+	s := config.Totalizer
+	if !s.Enabled {
+		return
+	}
+	job, err := newTotalizerJob(s, db)
+	if err == nil {
+		err = errMySQLOnly("totalizer")
+	}
+	if err != nil {
+		slog.Error("Totalizer disabled", "error", err)
+		return
+	}
+	slog.Info("Totalizer started", "interval", s.Interval, "daily_cutoff", s.DailyCutoff, "monthly_day", s.MonthlyDay)
+	go func() {
+		for {
+			job.run()
+			time.Sleep(s.Interval)
+		}
+	}()
+}
+
+func newTotalizerJob(s TotalizerConfig, db *sql.DB) (*totalizerJob, error) {
+	if s.Interval <= 0 {
+		s.Interval = 5 * time.Minute
+	}
+	if s.Settle <= 0 {
+		s.Settle = 2 * time.Minute
+	}
+	if s.DailyCutoff == "" {
+		s.DailyCutoff = "00:00"
+	}
+	if s.MonthlyDay == 0 {
+		s.MonthlyDay = 1
+	}
+	cutoff, err := time.Parse("15:04", s.DailyCutoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daily_cutoff %q, use HH:MM", s.DailyCutoff)
+	}
+	// Later days do not exist in every month
+	if s.MonthlyDay < 1 || s.MonthlyDay > 28 {
+		return nil, fmt.Errorf("monthly_day must be between 1 and 28")
+	}
+	job := &totalizerJob{
+		states:     mysqlTotalizerStates{db: db},
+		settings:   s,
+		cutoffHour: cutoff.Hour(),
+		cutoffMin:  cutoff.Minute(),
+		projects:   make(map[string]bool),
+		channels:   [2]TotalizerChannel{s.Totalizer1, s.Totalizer2},
+	}
+	for _, p := range s.Projects {
+		job.projects[p] = true
+	}
+	for i := range job.channels {
+		c := &job.channels[i]
+		if c.Sensor < 0 || c.Sensor > 4 {
+			return nil, fmt.Errorf("totalizer%d: sensor must be between 1 and 4", i+1)
+		}
+		if c.Mode == "" {
+			c.Mode = "flow"
+		}
+		if c.Mode != "flow" && c.Mode != "counter" {
+			return nil, fmt.Errorf("totalizer%d: mode must be flow or counter", i+1)
+		}
+		if c.RateUnit <= 0 {
+			c.RateUnit = time.Hour
+		}
+		if c.Scale == 0 {
+			c.Scale = 1
+		}
+		if c.MaxGap <= 0 {
+			c.MaxGap = time.Hour
+		}
+	}
+	if job.channels[0].Sensor == 0 && job.channels[1].Sensor == 0 {
+		return nil, fmt.Errorf("neither totalizer1 nor totalizer2 has a sensor")
+	}
+	return job, nil
+}
+
+func (j *totalizerJob) run() {
+	devices, err := store.Devices("")
+	if err != nil {
+		slog.Error("Totalizer: loading devices failed", "error", err)
+		return
+	}
+	to := localNow().Add(-j.settings.Settle)
+	for _, d := range devices {
+		if len(j.projects) > 0 && !j.projects[d.Project] {
+			continue
+		}
+		if err := j.runDevice(d.DeviceID, to); err != nil {
+			slog.Error("Totalizer: device failed", "deviceID", d.DeviceID, "error", err)
+		}
+	}
+}
+
+// runDevice integrates the readings up to to and latches the periods that
+// ended before it.
+func (j *totalizerJob) runDevice(deviceID string, to time.Time) error {
+	st, err := j.loadState(deviceID, to)
+	if err != nil {
+		return err
+	}
+	// Readings up to the second of the last one processed were counted in an
+	// earlier run, or arrived too late to be
+	from, done := st.MonthStart, st.LastTime
+	if done != nil {
+		from = *done
+	}
+	if !from.Before(to) {
+		return nil
+	}
+	added := 0
+	for offset := 0; ; offset += totalizerBatch {
+		readings, err := store.History(deviceID, from, to, totalizerBatch, offset)
+		if err != nil {
+			return err
+		}
+		for _, r := range readings {
+			if done == nil || r.Time.After(*done) {
+				j.add(st, r)
+				added++
+			}
+		}
+		if len(readings) < totalizerBatch {
+			break
+		}
+	}
+	// Latch the periods that ended without readings, except one a reading
+	// still to come may straddle, since part of that step belongs to it
+	until := to
+	if st.LastTime != nil {
+		j.advanceTo(st, *st.LastTime, *st.LastTime, [2]float64{})
+		if !j.nextCutoff(st).After(st.LastTime.Add(j.maxGap())) {
+			until = *st.LastTime
+		}
+	}
+	j.advanceTo(st, until, until, [2]float64{})
+	if added == 0 && len(st.latched) == 0 && st.stored {
+		return nil
+	}
+	return j.saveState(st)
+}
+
+// add integrates the step from the previous reading to r.
+func (j *totalizerJob) add(st *totalizerState, r Reading) {
+	var value [2]float64
+	for i, c := range j.channels {
+		if c.Sensor > 0 {
+			value[i] = r.Sensors[c.Sensor-1]
+		}
+	}
+	if st.LastTime != nil {
+		var inc [2]float64
+		for i, c := range j.channels {
+			inc[i] = c.increment(st.LastValue[i], value[i], r.Time.Sub(*st.LastTime))
+		}
+		j.advanceTo(st, *st.LastTime, r.Time, inc)
+	}
+	t := r.Time
+	st.LastTime, st.LastValue = &t, value
+}
+
+// advanceTo adds inc, spread evenly over from to t, and latches every period
+// that ends at or before t. A step across a cut-off is split in proportion to
+// time so each period gets its share.
+func (j *totalizerJob) advanceTo(st *totalizerState, from, t time.Time, inc [2]float64) {
+	segStart := from
+	addUntil := func(until time.Time) {
+		// Periods that ended before the step are latched empty
+		if !until.After(segStart) {
+			return
+		}
+		frac := 1.0
+		if span := t.Sub(from); span > 0 {
+			frac = float64(until.Sub(segStart)) / float64(span)
+		}
+		for i := range inc {
+			v := inc[i] * frac
+			st.Totalizer[i] += v
+			st.DayTotal[i] += v
+			st.MonthTotal[i] += v
+		}
+		segStart = until
+	}
+	for {
+		cutoff := j.nextCutoff(st)
+		if cutoff.After(t) {
+			break
+		}
+		addUntil(cutoff)
+		if nextDay := j.nextDay(st.DayStart); cutoff.Equal(nextDay) {
+			j.latch(st, "day", st.DayStart, nextDay, &st.DayTotal)
+			st.DayStart = nextDay
+		}
+		if nextMonth := j.nextMonth(st.MonthStart); cutoff.Equal(nextMonth) {
+			j.latch(st, "month", st.MonthStart, nextMonth, &st.MonthTotal)
+			st.MonthStart = nextMonth
+		}
+	}
+	addUntil(t)
+}
+
+// nextCutoff returns the end of the current day or month, whichever is first.
+func (j *totalizerJob) nextCutoff(st *totalizerState) time.Time {
+	cutoff := j.nextDay(st.DayStart)
+	if nextMonth := j.nextMonth(st.MonthStart); nextMonth.Before(cutoff) {
+		cutoff = nextMonth
+	}
+	return cutoff
+}
+
+// maxGap returns the longest max_gap of the channels in use.
+func (j *totalizerJob) maxGap() time.Duration {
+	var gap time.Duration
+	for _, c := range j.channels {
+		if c.Sensor > 0 && c.MaxGap > gap {
+			gap = c.MaxGap
+		}
+	}
+	return gap
+}
+
+func (j *totalizerJob) latch(st *totalizerState, period string, start, end time.Time, total *[2]float64) {
+	st.latched = append(st.latched, latchedTotal{Period: period, Start: start, End: end, Total: *total, Totalizer: st.Totalizer})
+	*total = [2]float64{}
+}
+
+// increment is the amount added between two readings step apart.
+func (c TotalizerChannel) increment(prev, cur float64, step time.Duration) float64 {
+	switch {
+	case c.Sensor == 0:
+		return 0
+	case c.Mode == "counter":
+		if cur < prev {
+			return cur * c.Scale
+		}
+		return (cur - prev) * c.Scale
+	case step > c.MaxGap:
+		return 0
+	}
+	return (prev + cur) / 2 * float64(step) / float64(c.RateUnit) * c.Scale
+}
+
+// dayStart returns the last daily cut-off at or before t.
+func (j *totalizerJob) dayStart(t time.Time) time.Time {
+	d := time.Date(t.Year(), t.Month(), t.Day(), j.cutoffHour, j.cutoffMin, 0, 0, location)
+	if d.After(t) {
+		d = d.AddDate(0, 0, -1)
+	}
+	return d
+}
+
+func (j *totalizerJob) nextDay(start time.Time) time.Time {
+	return time.Date(start.Year(), start.Month(), start.Day()+1, j.cutoffHour, j.cutoffMin, 0, 0, location)
+}
+
+// monthStart returns the last monthly cut-off at or before t.
+func (j *totalizerJob) monthStart(t time.Time) time.Time {
+	d := time.Date(t.Year(), t.Month(), j.settings.MonthlyDay, j.cutoffHour, j.cutoffMin, 0, 0, location)
+	if d.After(t) {
+		d = time.Date(t.Year(), t.Month()-1, j.settings.MonthlyDay, j.cutoffHour, j.cutoffMin, 0, 0, location)
+	}
+	return d
+}
+
+func (j *totalizerJob) nextMonth(start time.Time) time.Time {
+	return time.Date(start.Year(), start.Month()+1, j.settings.MonthlyDay, j.cutoffHour, j.cutoffMin, 0, 0, location)
+}
+
+// totalizerStates stores the progress of every device with the totals it
+// latched.
+type totalizerStates interface {
+	// load returns nil for a device without stored progress.
+	load(deviceID string) (*totalizerState, error)
+	save(st *totalizerState) error
+}
+
+// mysqlTotalizerStates keeps the progress in totalizer_state and the latched
+// totals in totalizer_latched.
+type mysqlTotalizerStates struct {
+	db *sql.DB
+}
+
+// loadState reads the progress of a device. A device seen for the first time
+// starts from the rdas_dev totalizers and is integrated from the start of the
+// current month.
+func (j *totalizerJob) loadState(deviceID string, now time.Time) (*totalizerState, error) {
+	st, err := j.states.load(deviceID)
+	if err != nil || st != nil {
+		return st, err
+	}
+	st = &totalizerState{DeviceID: deviceID}
+	st.Totalizer[0], st.Totalizer[1], err = store.Totalizers(deviceID)
+	st.MonthStart = j.monthStart(now)
+	st.DayStart = j.dayStart(st.MonthStart)
+	return st, err
+}
+
+// saveState stores the progress and the latched totals, then copies the
+// totals to rdas_dev.
+func (j *totalizerJob) saveState(st *totalizerState) error {
+	if err := j.states.save(st); err != nil {
+		return err
+	}
+	totals := DeviceTotals{Totalizer1: st.Totalizer[0], Totalizer2: st.Totalizer[1], MonthlyTotal: int64(math.Round(st.MonthTotal[0]))}
+	for _, l := range st.latched {
+		if l.Period == "day" {
+			totals.DailyLatched = latchedValue(l.Start, l.Total[0])
+		} else {
+			totals.MonthlyLatched = latchedValue(l.Start, l.Total[0])
+		}
+		metricLatched.inc(l.Period)
+		slog.Info("Totalizer latched", "deviceID", st.DeviceID, "period", l.Period, "start", l.Start.Format(sqlDateTime), "total1", l.Total[0], "total2", l.Total[1])
+	}
+	st.latched = nil
+	return store.UpdateTotals(st.DeviceID, totals)
+}
+
+func (m mysqlTotalizerStates) load(deviceID string) (*totalizerState, error) {
+	st := &totalizerState{DeviceID: deviceID, stored: true}
+	var lastTime sql.NullString
+	var dayStart, monthStart string
+	err := m.db.QueryRow(`SELECT last_time, last_value1, last_value2, totalizer1, totalizer2,
+		day_start, day_total1, day_total2, month_start, month_total1, month_total2
+		FROM totalizer_state WHERE devID = ?`, deviceID).
+		Scan(&lastTime, &st.LastValue[0], &st.LastValue[1], &st.Totalizer[0], &st.Totalizer[1],
+			&dayStart, &st.DayTotal[0], &st.DayTotal[1], &monthStart, &st.MonthTotal[0], &st.MonthTotal[1])
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lastTime.Valid {
+		t, err := time.ParseInLocation(sqlDateTime, lastTime.String, location)
+		if err != nil {
+			return nil, err
+		}
+		st.LastTime = &t
+	}
+	if st.DayStart, err = time.ParseInLocation(sqlDateTime, dayStart, location); err != nil {
+		return nil, err
+	}
+	if st.MonthStart, err = time.ParseInLocation(sqlDateTime, monthStart, location); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// save stores the progress and the latched totals together.
+func (m mysqlTotalizerStates) save(st *totalizerState) error {
+	now := localNow().Format(sqlDateTime)
+	var lastTime interface{}
+	if st.LastTime != nil {
+		lastTime = st.LastTime.Format(sqlDateTime)
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = execSQL(tx, "save_totalizer_state", st.DeviceID, `INSERT INTO totalizer_state (devID, last_time, last_value1, last_value2, totalizer1, totalizer2,
+		day_start, day_total1, day_total2, month_start, month_total1, month_total2, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE last_time = VALUES(last_time), last_value1 = VALUES(last_value1), last_value2 = VALUES(last_value2),
+		totalizer1 = VALUES(totalizer1), totalizer2 = VALUES(totalizer2),
+		day_start = VALUES(day_start), day_total1 = VALUES(day_total1), day_total2 = VALUES(day_total2),
+		month_start = VALUES(month_start), month_total1 = VALUES(month_total1), month_total2 = VALUES(month_total2),
+		updated_at = VALUES(updated_at)`,
+		st.DeviceID, lastTime, st.LastValue[0], st.LastValue[1], st.Totalizer[0], st.Totalizer[1],
+		st.DayStart.Format(sqlDateTime), st.DayTotal[0], st.DayTotal[1],
+		st.MonthStart.Format(sqlDateTime), st.MonthTotal[0], st.MonthTotal[1], now)
+	if err != nil {
+		return err
+	}
+	for _, l := range st.latched {
+		_, err = execSQL(tx, "insert_totalizer_latched", st.DeviceID, `INSERT INTO totalizer_latched (devID, period, period_start, period_end, total1, total2, totalizer1, totalizer2, latched_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE period_end = VALUES(period_end), total1 = VALUES(total1), total2 = VALUES(total2),
+			totalizer1 = VALUES(totalizer1), totalizer2 = VALUES(totalizer2), latched_at = VALUES(latched_at)`,
+			st.DeviceID, l.Period, l.Start.Format(sqlDateTime), l.End.Format(sqlDateTime), l.Total[0], l.Total[1], l.Totalizer[0], l.Totalizer[1], now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// latchedValue formats a latched amount for the DailyLatched and
+// MonthlyLatched columns as DD_MM_value, the layout of their D_M_000 default.
+// The columns hold 16 characters, so large values lose precision.
+func latchedValue(start time.Time, v float64) string {
+	prefix := start.Format("02_01_")
+	for _, s := range []string{
+		strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64),
+		strconv.FormatFloat(math.Round(v), 'f', 0, 64),
+	} {
+		if len(prefix+s) <= 16 {
+			return prefix + s
+		}
+	}
+	return prefix + strconv.FormatFloat(v, 'e', 3, 64)
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTotalizerIncrement(t *testing.T) {
+	flow := TotalizerChannel{Sensor: 1, Mode: "flow", RateUnit: time.Hour, Scale: 1, MaxGap: time.Hour}
+	counter := TotalizerChannel{Sensor: 1, Mode: "counter", Scale: 1}
+	tests := []struct {
+		name      string
+		c         TotalizerChannel
+		prev, cur float64
+		step      time.Duration
+		want      float64
+	}{
+		{"flow constant", flow, 10, 10, 30 * time.Minute, 5},
+		{"flow trapezoid", flow, 10, 20, time.Hour, 15},
+		{"flow per minute", TotalizerChannel{Sensor: 1, Mode: "flow", RateUnit: time.Minute, Scale: 1, MaxGap: time.Hour}, 2, 4, 10 * time.Minute, 30},
+		{"flow scaled", TotalizerChannel{Sensor: 1, Mode: "flow", RateUnit: time.Hour, Scale: 0.001, MaxGap: time.Hour}, 1000, 1000, time.Hour, 1},
+		{"flow at max gap", flow, 10, 10, time.Hour, 10},
+		{"flow over max gap", flow, 10, 10, time.Hour + time.Second, 0},
+		{"counter increase", counter, 100, 160, time.Hour, 60},
+		{"counter unchanged", counter, 100, 100, time.Hour, 0},
+		{"counter reset", counter, 100, 20, time.Hour, 20},
+		{"counter over max gap", counter, 100, 160, 48 * time.Hour, 60},
+		{"counter scaled", TotalizerChannel{Sensor: 1, Mode: "counter", Scale: 10}, 5, 7, time.Minute, 20},
+		{"no sensor", TotalizerChannel{}, 10, 20, time.Hour, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.c.increment(tt.prev, tt.cur, tt.step); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: increment = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTotalizerCutoff(t *testing.T) {
+	defer func(l *time.Location) { location = l }(location)
+	location = time.UTC
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, location)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	type reading struct {
+		time  string
+		value float64
+	}
+	tests := []struct {
+		name     string
+		mode     string
+		readings []reading
+		latched  []string
+		day      float64
+		total    float64
+	}{
+		{
+			name:     "flow split at the daily cut-off",
+			mode:     "flow",
+			readings: []reading{{"2024-04-30 05:30", 10}, {"2024-04-30 06:30", 10}},
+			latched:  []string{"day 2024-04-29 06:00-2024-04-30 06:00 5"},
+			day:      5, total: 10,
+		},
+		{
+			name:     "flow split in proportion to time",
+			mode:     "flow",
+			readings: []reading{{"2024-04-30 05:30", 20}, {"2024-04-30 06:30", 20}, {"2024-04-30 07:00", 20}},
+			latched:  []string{"day 2024-04-29 06:00-2024-04-30 06:00 10"},
+			day:      20, total: 30,
+		},
+		{
+			name:     "flow gap over max_gap counts nothing",
+			mode:     "flow",
+			readings: []reading{{"2024-04-30 05:00", 10}, {"2024-04-30 08:00", 10}},
+			latched:  []string{"day 2024-04-29 06:00-2024-04-30 06:00 0"},
+		},
+		{
+			name:     "counter split at the daily cut-off",
+			mode:     "counter",
+			readings: []reading{{"2024-04-30 05:30", 100}, {"2024-04-30 06:30", 160}},
+			latched:  []string{"day 2024-04-29 06:00-2024-04-30 06:00 30"},
+			day:      30, total: 60,
+		},
+		{
+			name:     "counter reset",
+			mode:     "counter",
+			readings: []reading{{"2024-04-30 05:00", 100}, {"2024-04-30 05:30", 20}, {"2024-04-30 05:45", 50}},
+			day:      50, total: 50,
+		},
+		{
+			name:     "day and month end at the same cut-off",
+			mode:     "counter",
+			readings: []reading{{"2024-05-01 05:00", 0}, {"2024-05-01 07:00", 40}},
+			latched: []string{
+				"day 2024-04-30 06:00-2024-05-01 06:00 20",
+				"month 2024-04-01 06:00-2024-05-01 06:00 20",
+			},
+			day: 20, total: 40,
+		},
+		{
+			name:     "days without readings are latched empty",
+			mode:     "counter",
+			readings: []reading{{"2024-04-30 05:00", 0}, {"2024-05-02 05:00", 48}},
+			latched: []string{
+				"day 2024-04-29 06:00-2024-04-30 06:00 1",
+				"day 2024-04-30 06:00-2024-05-01 06:00 24",
+				"month 2024-04-01 06:00-2024-05-01 06:00 25",
+			},
+			day: 23, total: 48,
+		},
+	}
+	for _, tt := range tests {
+		job, err := newTotalizerJob(TotalizerConfig{
+			DailyCutoff: "06:00",
+			Totalizer1:  TotalizerChannel{Sensor: 1, Mode: tt.mode},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := at(tt.readings[0].time)
+		st := &totalizerState{DeviceID: "dev1", DayStart: job.dayStart(first), MonthStart: job.monthStart(first)}
+		for _, r := range tt.readings {
+			job.add(st, Reading{DeviceID: "dev1", Time: at(r.time), Sensors: [4]float64{r.value}})
+		}
+		var latched []string
+		for _, l := range st.latched {
+			latched = append(latched, fmt.Sprintf("%s %s-%s %g", l.Period, l.Start.Format("2006-01-02 15:04"), l.End.Format("2006-01-02 15:04"), l.Total[0]))
+		}
+		if fmt.Sprint(latched) != fmt.Sprint(tt.latched) {
+			t.Errorf("%s: latched %q, want %q", tt.name, latched, tt.latched)
+		}
+		if math.Abs(st.DayTotal[0]-tt.day) > 1e-9 || math.Abs(st.Totalizer[0]-tt.total) > 1e-9 {
+			t.Errorf("%s: day total %v, totalizer %v, want %v, %v", tt.name, st.DayTotal[0], st.Totalizer[0], tt.day, tt.total)
+		}
+	}
+}
+
+// totalizerTestStore serves History from readings and keeps the progress
+// saved by the job in memory.
+type totalizerTestStore struct {
+	Store
+	readings []Reading
+	state    *totalizerState
+	latched  []string
+}
+
+func (s *totalizerTestStore) History(deviceID string, from, to time.Time, limit, offset int) ([]Reading, error) {
+	var out []Reading
+	for _, r := range s.readings {
+		if !r.Time.Before(from) && r.Time.Before(to) {
+			out = append(out, r)
+		}
+	}
+	out = out[min(offset, len(out)):]
+	return out[:min(limit, len(out))], nil
+}
+
+func (s *totalizerTestStore) Totalizers(deviceID string) (float64, float64, error) { return 0, 0, nil }
+
+func (s *totalizerTestStore) UpdateTotals(deviceID string, t DeviceTotals) error { return nil }
+
+func (s *totalizerTestStore) load(deviceID string) (*totalizerState, error) {
+	if s.state == nil {
+		return nil, nil
+	}
+	st := *s.state
+	st.stored = true
+	return &st, nil
+}
+
+func (s *totalizerTestStore) save(st *totalizerState) error {
+	for _, l := range st.latched {
+		s.latched = append(s.latched, fmt.Sprintf("%s %s %g", l.Period, l.Start.Format("2006-01-02 15:04"), l.Total[0]))
+	}
+	saved := *st
+	saved.latched = nil
+	s.state = &saved
+	return nil
+}
+
+func TestTotalizerRunDevice(t *testing.T) {
+	defer func(l *time.Location, s Store) { location, store = l, s }(location, store)
+	location = time.UTC
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, location)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	type reading struct {
+		time  string
+		value float64
+	}
+	tests := []struct {
+		name     string
+		channel  TotalizerChannel
+		readings []reading
+		runs     []string
+		latched  []string
+		day      float64
+	}{
+		{
+			name:     "flow reading after the cut-off arrives in a later run",
+			channel:  TotalizerChannel{Sensor: 1, Mode: "flow", MaxGap: 3 * time.Hour},
+			readings: []reading{{"2024-04-30 05:00", 10}, {"2024-04-30 07:00", 10}},
+			runs:     []string{"2024-04-30 05:30", "2024-04-30 06:30", "2024-04-30 07:30"},
+			latched:  []string{"day 2024-04-29 06:00 10"},
+			day:      10,
+		},
+		{
+			name:     "counter reading after the cut-off arrives in a later run",
+			channel:  TotalizerChannel{Sensor: 1, Mode: "counter"},
+			readings: []reading{{"2024-04-30 05:30", 100}, {"2024-04-30 06:30", 160}},
+			runs:     []string{"2024-04-30 05:45", "2024-04-30 06:10", "2024-04-30 06:20", "2024-04-30 07:00"},
+			latched:  []string{"day 2024-04-29 06:00 30"},
+			day:      30,
+		},
+		{
+			name:     "period waits for the next reading",
+			channel:  TotalizerChannel{Sensor: 1, Mode: "counter"},
+			readings: []reading{{"2024-04-30 05:30", 100}},
+			runs:     []string{"2024-04-30 05:45", "2024-04-30 06:20"},
+		},
+		{
+			name:     "period latched once max_gap has passed",
+			channel:  TotalizerChannel{Sensor: 1, Mode: "flow", MaxGap: 30 * time.Minute},
+			readings: []reading{{"2024-04-30 04:30", 10}, {"2024-04-30 05:00", 10}, {"2024-04-30 08:00", 10}},
+			runs:     []string{"2024-04-30 05:10", "2024-04-30 06:10"},
+			latched:  []string{"day 2024-04-29 06:00 5"},
+		},
+		{
+			name:     "reading exactly at the cut-off",
+			channel:  TotalizerChannel{Sensor: 1, Mode: "counter"},
+			readings: []reading{{"2024-04-30 05:30", 100}, {"2024-04-30 06:00", 130}, {"2024-04-30 06:30", 150}},
+			runs:     []string{"2024-04-30 05:45", "2024-04-30 06:10", "2024-04-30 07:00"},
+			latched:  []string{"day 2024-04-29 06:00 30"},
+			day:      20,
+		},
+	}
+	for _, tt := range tests {
+		job, err := newTotalizerJob(TotalizerConfig{DailyCutoff: "06:00", Totalizer1: tt.channel}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := &totalizerTestStore{}
+		for _, r := range tt.readings {
+			ts.readings = append(ts.readings, Reading{DeviceID: "dev1", Time: at(r.time), Sensors: [4]float64{r.value}})
+		}
+		// The first run starts mid-day so the month so far has no readings
+		ts.state = &totalizerState{DeviceID: "dev1", DayStart: at("2024-04-29 06:00"), MonthStart: at("2024-04-01 06:00")}
+		store, job.states = ts, ts
+		for _, run := range tt.runs {
+			if err := job.runDevice("dev1", at(run)); err != nil {
+				t.Fatalf("%s: runDevice(%s): %v", tt.name, run, err)
+			}
+		}
+		if fmt.Sprint(ts.latched) != fmt.Sprint(tt.latched) {
+			t.Errorf("%s: latched %q, want %q", tt.name, ts.latched, tt.latched)
+		}
+		if math.Abs(ts.state.DayTotal[0]-tt.day) > 1e-9 {
+			t.Errorf("%s: day total %v, want %v", tt.name, ts.state.DayTotal[0], tt.day)
+		}
+	}
+}